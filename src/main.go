@@ -22,7 +22,6 @@ import (
 	"fmt"
 	"time"
 	"net/http"
-	"math/rand"
 	"restreamer"
 )
 
@@ -31,6 +30,8 @@ const (
 	eventMainConfig = "config"
 	eventMainConfigStream = "stream"
 	eventMainConfigStatic = "static"
+	eventMainConfigIngest = "ingest"
+	eventMainConfigProgram = "program"
 	eventMainConfigApi = "api"
 	eventMainHandled = "handled"
 	eventMainStartMonitor = "start_monitor"
@@ -39,19 +40,47 @@ const (
 	errorMainStreamNotFound = "stream_notfound"
 	errorMainInvalidApi = "invalid_api"
 	errorMainInvalidResource = "invalid_resource"
+	errorMainInvalidFallback = "invalid_fallback"
+	errorMainInvalidTls = "invalid_tls"
+	errorMainInvalidBinding = "invalid_binding"
+	errorMainInvalidProgram = "invalid_program"
 )
 
-// Shuffle shuffles a slice using Knuth's version of the Fisher-Yates algorithm.
-func ShuffleStrings(rnd *rand.Rand, list []string) []string {
-	N := len(list)
-	ret := make([]string, N)
-	copy(ret, list)
-	for i := 0; i < N; i++ {
-		// choose index uniformly in [i, N-1]
-		r := i + rnd.Intn(N - i)
-		ret[r], ret[i] = ret[i], ret[r]
+// loadTls creates a TLS loader for a resource.
+// Returns nil if the resource has no TLS settings, or if they are invalid.
+func loadTls(config restreamer.TlsConfig, logger restreamer.JsonLogger) *restreamer.TlsLoader {
+	if config == (restreamer.TlsConfig{}) {
+		return nil
 	}
-	return ret
+	loader, err := restreamer.NewTlsLoader(config)
+	if err != nil {
+		logger.Log(restreamer.Dict{
+			"event": eventMainError,
+			"error": errorMainInvalidTls,
+			"message": fmt.Sprintf("Error loading TLS settings: %s", err),
+		})
+		return nil
+	}
+	loader.SetLogger(logger)
+	return loader
+}
+
+// loadFallback loads the fallback file of a resource.
+func loadFallback(path string, logger restreamer.JsonLogger) *restreamer.Fallback {
+	if path == "" {
+		return nil
+	}
+	fallback, err := restreamer.LoadFallback(path)
+	if err != nil {
+		logger.Log(restreamer.Dict{
+			"event": eventMainError,
+			"error": errorMainInvalidFallback,
+			"fallback": path,
+			"message": fmt.Sprintf("Error loading fallback %s: %s", path, err),
+		})
+		return nil
+	}
+	return fallback
 }
 
 func main() {
@@ -97,9 +126,9 @@ func main() {
 		logger = flogger
 	}
 	
-	rnd := rand.New(rand.NewSource(time.Now().Unix()))
-	
-	clients := make(map[string]*restreamer.Client)
+	sources := make(map[string]restreamer.StateSource)
+	streams := make(map[string]restreamer.ProgramSource)
+	streamers := make(map[string]*restreamer.Streamer)
 	
 	i := 0
 	mux := http.NewServeMux()
@@ -116,19 +145,41 @@ func main() {
 			reg := stats.RegisterStream(streamdef.Serve)
 			
 			streamer := restreamer.NewStreamer(config.OutputBuffer, controller)
+			streamer.Grace = time.Duration(config.Grace) * time.Second
+			streamer.PidTimeout = time.Duration(config.PidTimeout) * time.Second
+			streamer.SetProfiles(streamdef.Profiles)
 			streamer.SetCollector(reg)
 			streamer.SetLogger(logger)
+			if fallback := loadFallback(streamdef.Fallback, logger); fallback != nil {
+				streamer.SetFallback(fallback)
+			}
 			
-			// shuffle the list here, not later
-			// should give a bit more randomness
-			remotes := ShuffleStrings(rnd, streamdef.Remotes)
-			
-			client, err := restreamer.NewClient(remotes, streamer, config.Timeout, config.Reconnect, config.ReadTimeout, config.InputBuffer)
+			client, err := restreamer.NewClient(streamdef.Remotes, streamer, config.Timeout, config.Reconnect, config.ReadTimeout, config.InputBuffer)
 			if err == nil {
+				client.MaxWait = time.Duration(config.ReconnectMax) * time.Second
+				client.Jitter = config.Jitter
+				client.HoldDown = time.Duration(config.HoldDown) * time.Second
+				client.MaxRedirects = config.MaxRedirects
+				client.ContentTypes = config.ContentTypes
+				client.SyncPackets = config.SyncPackets
+				client.Resolve = streamdef.Resolve
+				client.ResolveInterval = time.Duration(config.ResolveInterval) * time.Second
+				if streamdef.OnDemand {
+					client.OnDemand = true
+					client.Linger = time.Duration(config.Linger) * time.Second
+					streamer.DemandTimeout = time.Duration(config.DemandTimeout) * time.Second
+					streamer.SetDemandListener(client)
+				}
 				client.SetCollector(reg)
 				client.SetLogger(logger)
+				client.SetStateListener(streamer)
+				if tls := loadTls(streamdef.Tls, logger); tls != nil {
+					client.SetTls(tls)
+				}
 				client.Connect()
-				clients[streamdef.Serve] = client
+				sources[streamdef.Serve] = client
+				streams[streamdef.Serve] = streamer
+				streamers[streamdef.Serve] = streamer
 				mux.Handle(streamdef.Serve, streamer)
 				
 				logger.Log(restreamer.Dict{
@@ -141,6 +192,97 @@ func main() {
 				log.Print(err)
 			}
 			
+		case "ingest":
+			logger.Log(restreamer.Dict{
+				"event": eventMainConfigIngest,
+				"serve": streamdef.Serve,
+				"message": fmt.Sprintf("Accepting published stream on %s", streamdef.Serve),
+			})
+			
+			reg := stats.RegisterStream(streamdef.Serve)
+			
+			streamer := restreamer.NewStreamer(config.OutputBuffer, controller)
+			streamer.Grace = time.Duration(config.Grace) * time.Second
+			streamer.PidTimeout = time.Duration(config.PidTimeout) * time.Second
+			streamer.SetProfiles(streamdef.Profiles)
+			streamer.SetCollector(reg)
+			streamer.SetLogger(logger)
+			if fallback := loadFallback(streamdef.Fallback, logger); fallback != nil {
+				streamer.SetFallback(fallback)
+			}
+			
+			ingest := restreamer.NewIngest(streamer, streamdef.Key, config.InputBuffer)
+			ingest.SetCollector(reg)
+			ingest.SetLogger(logger)
+			ingest.ReadTimeout = time.Duration(config.ReadTimeout) * time.Second
+			ingest.Start()
+			sources[streamdef.Serve] = ingest
+			streams[streamdef.Serve] = streamer
+			streamers[streamdef.Serve] = streamer
+			mux.Handle(streamdef.Serve, ingest)
+			
+			logger.Log(restreamer.Dict{
+				"event": eventMainHandled,
+				"number": i,
+				"message": fmt.Sprintf("Handled connection %d", i),
+			})
+			i++
+			
+		case "program":
+			logger.Log(restreamer.Dict{
+				"event": eventMainConfigProgram,
+				"serve": streamdef.Serve,
+				"remote": streamdef.Remote,
+				"program": streamdef.Program,
+				"message": fmt.Sprintf("Extracting program %d of %s on %s", streamdef.Program, streamdef.Remote, streamdef.Serve),
+			})
+			
+			parent := streamers[streamdef.Remote]
+			if parent == nil {
+				logger.Log(restreamer.Dict{
+					"event": eventMainError,
+					"error": errorMainStreamNotFound,
+					"remote": streamdef.Remote,
+					"message": fmt.Sprintf("Error, stream not found: %s", streamdef.Remote),
+				})
+				break
+			}
+			if streamdef.Program == 0 {
+				logger.Log(restreamer.Dict{
+					"event": eventMainError,
+					"error": errorMainInvalidProgram,
+					"serve": streamdef.Serve,
+					"message": fmt.Sprintf("Error, no program number for %s", streamdef.Serve),
+				})
+				break
+			}
+			
+			reg := stats.RegisterStream(streamdef.Serve)
+			
+			streamer := restreamer.NewStreamer(config.OutputBuffer, controller)
+			streamer.Grace = time.Duration(config.Grace) * time.Second
+			streamer.PidTimeout = time.Duration(config.PidTimeout) * time.Second
+			streamer.DemandTimeout = time.Duration(config.DemandTimeout) * time.Second
+			streamer.SetProfiles(streamdef.Profiles)
+			streamer.SetCollector(reg)
+			streamer.SetLogger(logger)
+			if fallback := loadFallback(streamdef.Fallback, logger); fallback != nil {
+				streamer.SetFallback(fallback)
+			}
+			
+			parent.Extract(streamdef.Program, streamer, config.InputBuffer)
+			// the upstream is the one of the parent
+			sources[streamdef.Serve] = sources[streamdef.Remote]
+			streams[streamdef.Serve] = streamer
+			mux.Handle(streamdef.Serve, streamer)
+			
+			logger.Log(restreamer.Dict{
+				"event": eventMainHandled,
+				"number": i,
+				"message": fmt.Sprintf("Handled connection %d", i),
+			})
+			i++
+			
 		case "static":
 			logger.Log(restreamer.Dict{
 				"event": eventMainConfigStatic,
@@ -154,6 +296,20 @@ func main() {
 			} else {
 				proxy.SetStatistics(stats)
 				proxy.SetLogger(logger)
+				proxy.SetCredentials(streamdef.Credentials)
+				if tls := loadTls(streamdef.Tls, logger); tls != nil {
+					proxy.SetTls(tls)
+				}
+				if streamdef.Binding != (restreamer.Binding{}) {
+					if err := proxy.SetBinding(streamdef.Binding); err != nil {
+						logger.Log(restreamer.Dict{
+							"event": eventMainError,
+							"error": errorMainInvalidBinding,
+							"serve": streamdef.Serve,
+							"message": fmt.Sprintf("Error binding %s to %s %s: %s", streamdef.Serve, streamdef.Bind, streamdef.Interface, err),
+						})
+					}
+				}
 				mux.Handle(streamdef.Serve, proxy)
 			}
 			
@@ -182,9 +338,9 @@ func main() {
 					"serve": streamdef.Serve,
 					"message": fmt.Sprintf("Registering stream check API on %s", streamdef.Serve),
 				})
-				client := clients[streamdef.Remote]
-				if client != nil {
-					mux.Handle(streamdef.Serve, restreamer.NewStreamStateApi(client))
+				source := sources[streamdef.Remote]
+				if source != nil {
+					mux.Handle(streamdef.Serve, restreamer.NewStreamStateApi(source))
 				} else {
 					logger.Log(restreamer.Dict{
 						"event": eventMainError,
@@ -194,6 +350,25 @@ func main() {
 						"message": fmt.Sprintf("Error, stream not found: %s", streamdef.Remote),
 					})
 				}
+			case "programs":
+				logger.Log(restreamer.Dict{
+					"event": eventMainConfigApi,
+					"api": "programs",
+					"serve": streamdef.Serve,
+					"message": fmt.Sprintf("Registering program info API on %s", streamdef.Serve),
+				})
+				stream := streams[streamdef.Remote]
+				if stream != nil {
+					mux.Handle(streamdef.Serve, restreamer.NewProgramApi(stream))
+				} else {
+					logger.Log(restreamer.Dict{
+						"event": eventMainError,
+						"error": errorMainStreamNotFound,
+						"api": "programs",
+						"remote": streamdef.Remote,
+						"message": fmt.Sprintf("Error, stream not found: %s", streamdef.Remote),
+					})
+				}
 			default:
 				logger.Log(restreamer.Dict{
 					"event": eventMainError,
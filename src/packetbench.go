@@ -0,0 +1,176 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"restreamer"
+)
+
+// number of packets in the test pattern
+const patternPackets = 1000
+
+// streamReader is an endless stream of TS packets.
+// Each Read returns at most chunk bytes, like a network socket would.
+type streamReader struct {
+	pattern []byte
+	offset int
+	chunk int
+}
+func newStreamReader(chunk int) *streamReader {
+	pattern := make([]byte, patternPackets * restreamer.PacketSize)
+	for i := 0; i < len(pattern); i += restreamer.PacketSize {
+		pattern[i] = restreamer.SyncByte
+		pattern[i + 1] = byte(i >> 8) & 0x1f
+		pattern[i + 2] = byte(i)
+		pattern[i + 3] = 0x10
+	}
+	return &streamReader{
+		pattern: pattern,
+		chunk: chunk,
+	}
+}
+func (reader *streamReader) Read(data []byte) (int, error) {
+	if len(data) > reader.chunk {
+		data = data[:reader.chunk]
+	}
+	count := 0
+	for count < len(data) {
+		copied := copy(data[count:], reader.pattern[reader.offset:])
+		count += copied
+		reader.offset = (reader.offset + copied) % len(reader.pattern)
+	}
+	return count, nil
+}
+
+// benchmarkReadPacket reads b.N packets with ReadPacket.
+func benchmarkReadPacket(chunk int) func(*testing.B) {
+	return func(b *testing.B) {
+		reader := newStreamReader(chunk)
+		b.ReportAllocs()
+		b.SetBytes(restreamer.PacketSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			packet, err := restreamer.ReadPacket(reader)
+			if err != nil || packet == nil {
+				b.Fatal("read failed")
+			}
+		}
+	}
+}
+
+// benchmarkPacketReader reads b.N packets in batches with a PacketReader.
+func benchmarkPacketReader(chunk int) func(*testing.B) {
+	return func(b *testing.B) {
+		reader := restreamer.NewPacketReader(newStreamReader(chunk))
+		b.ReportAllocs()
+		b.SetBytes(restreamer.PacketSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; {
+			batch, err := reader.ReadBatch()
+			if err != nil {
+				b.Fatal("read failed")
+			}
+			i += batch.Len()
+			batch.Release()
+		}
+	}
+}
+
+// benchmarkFanoutPacket distributes b.N packets to a number of
+// consumers, one packet per queue entry.
+func benchmarkFanoutPacket(consumers int) func(*testing.B) {
+	return func(b *testing.B) {
+		reader := newStreamReader(restreamer.PacketSize)
+		queues := make([]chan restreamer.Packet, consumers)
+		done := make(chan bool)
+		for i := range queues {
+			queues[i] = make(chan restreamer.Packet, 100)
+			go func(queue chan restreamer.Packet) {
+				for _ = range queue {
+				}
+				done<- true
+			}(queues[i])
+		}
+		b.ReportAllocs()
+		b.SetBytes(restreamer.PacketSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			packet, _ := restreamer.ReadPacket(reader)
+			for _, queue := range queues {
+				queue<- packet
+			}
+		}
+		for _, queue := range queues {
+			close(queue)
+			<-done
+		}
+	}
+}
+
+// benchmarkFanoutBatch distributes b.N packets to a number of
+// consumers, in reference counted batches.
+func benchmarkFanoutBatch(consumers int) func(*testing.B) {
+	return func(b *testing.B) {
+		reader := restreamer.NewPacketReader(newStreamReader(7 * restreamer.PacketSize))
+		queues := make([]chan *restreamer.Batch, consumers)
+		done := make(chan bool)
+		for i := range queues {
+			queues[i] = make(chan *restreamer.Batch, restreamer.BatchQueueSize(100))
+			go func(queue chan *restreamer.Batch) {
+				for batch := range queue {
+					batch.Release()
+				}
+				done<- true
+			}(queues[i])
+		}
+		b.ReportAllocs()
+		b.SetBytes(restreamer.PacketSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; {
+			batch, _ := reader.ReadBatch()
+			i += batch.Len()
+			for _, queue := range queues {
+				batch.Retain()
+				queue<- batch
+			}
+			batch.Release()
+		}
+		for _, queue := range queues {
+			close(queue)
+			<-done
+		}
+	}
+}
+
+func run(name string, bench func(*testing.B)) {
+	result := testing.Benchmark(bench)
+	fmt.Printf("%-32s %s %s\n", name, result.String(), result.MemString())
+}
+
+func main() {
+	// 7 packets per read, like UDP and most HTTP sources
+	run("ReadPacket/1316", benchmarkReadPacket(7 * restreamer.PacketSize))
+	run("PacketReader/1316", benchmarkPacketReader(7 * restreamer.PacketSize))
+	// large reads, like a busy TCP connection
+	run("ReadPacket/65536", benchmarkReadPacket(65536))
+	run("PacketReader/65536", benchmarkPacketReader(65536))
+	// distribution to 10 clients
+	run("FanoutPacket/10", benchmarkFanoutPacket(10))
+	run("FanoutBatch/10", benchmarkFanoutBatch(10))
+}
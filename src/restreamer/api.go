@@ -18,6 +18,7 @@ package restreamer
 
 import (
 	"log"
+	"time"
 	"net/http"
 	"encoding/json"
 )
@@ -82,8 +83,38 @@ func NewStatisticsApi(stats Statistics) http.Handler {
 	}
 }
 
+// streamStatistics is the part of the statistics API response for a single stream.
+type streamStatistics struct {
+	Connected bool `json:"connected"`
+	Connections int `json:"connections"`
+	TotalPacketsReceived uint64 `json:"total_packets_received"`
+	TotalPacketsSent uint64 `json:"total_packets_sent"`
+	TotalPacketsDropped uint64 `json:"total_packets_dropped"`
+	PacketsPerSecondReceived uint64 `json:"packets_per_second_received"`
+	BytesPerSecondReceived uint64 `json:"bytes_per_second_received"`
+	TotalDatagramsLost uint64 `json:"total_datagrams_lost"`
+	TotalDatagramsDuplicated uint64 `json:"total_datagrams_duplicated"`
+	TotalSyncLosses uint64 `json:"total_sync_losses"`
+	TotalContinuityErrors uint64 `json:"total_continuity_errors"`
+	TotalTransportErrors uint64 `json:"total_transport_errors"`
+	TotalScrambledPackets uint64 `json:"total_scrambled_packets"`
+	TotalPidTimeouts uint64 `json:"total_pid_timeouts"`
+	TotalPcrErrors uint64 `json:"total_pcr_errors"`
+	Pids map[uint16]PidStatistics `json:"pids"`
+	PcrBitrate uint64 `json:"pcr_bitrate"`
+	PcrInterval float64 `json:"pcr_interval_ms"`
+	PcrMaxInterval float64 `json:"pcr_max_interval_ms"`
+	PcrJitter float64 `json:"pcr_jitter_ms"`
+}
+
+// milliseconds converts a duration to milliseconds, with microsecond precision.
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration / time.Microsecond) / 1000
+}
+
 // ServeHTTP is the http handler method.
-// It sends back information about system health.
+// It sends back the global statistics, followed by the statistics
+// of each stream, including the error counters of each PID.
 func (api *statisticsApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	global := api.stats.GetGlobalStatistics()
 	var stats struct {
@@ -102,6 +133,15 @@ func (api *statisticsApi) ServeHTTP(writer http.ResponseWriter, request *http.Re
 		BytesPerSecondReceived uint64 `json:"bytes_per_second_received"`
 		BytesPerSecondSent uint64 `json:"bytes_per_second_sent"`
 		BytesPerSecondDropped uint64 `json:"bytes_per_second_dropped"`
+		TotalDatagramsLost uint64 `json:"total_datagrams_lost"`
+		TotalDatagramsDuplicated uint64 `json:"total_datagrams_duplicated"`
+		TotalSyncLosses uint64 `json:"total_sync_losses"`
+		TotalContinuityErrors uint64 `json:"total_continuity_errors"`
+		TotalTransportErrors uint64 `json:"total_transport_errors"`
+		TotalScrambledPackets uint64 `json:"total_scrambled_packets"`
+		TotalPidTimeouts uint64 `json:"total_pid_timeouts"`
+		TotalPcrErrors uint64 `json:"total_pcr_errors"`
+		Streams map[string]streamStatistics `json:"streams"`
 	}
 	if global.Connections < global.MaxConnections {
 		stats.Status = "ok"
@@ -122,6 +162,39 @@ func (api *statisticsApi) ServeHTTP(writer http.ResponseWriter, request *http.Re
 	stats.BytesPerSecondReceived = global.BytesPerSecondReceived
 	stats.BytesPerSecondSent = global.BytesPerSecondSent
 	stats.BytesPerSecondDropped = global.BytesPerSecondDropped
+	stats.TotalDatagramsLost = global.TotalDatagramsLost
+	stats.TotalDatagramsDuplicated = global.TotalDatagramsDuplicated
+	stats.TotalSyncLosses = global.TotalSyncLosses
+	stats.TotalContinuityErrors = global.TotalContinuityErrors
+	stats.TotalTransportErrors = global.TotalTransportErrors
+	stats.TotalScrambledPackets = global.TotalScrambledPackets
+	stats.TotalPidTimeouts = global.TotalPidTimeouts
+	stats.TotalPcrErrors = global.TotalPcrErrors
+	stats.Streams = make(map[string]streamStatistics)
+	for name, stream := range api.stats.GetAllStreamStatistics() {
+		stats.Streams[name] = streamStatistics{
+			Connected: stream.Connected,
+			Connections: int(stream.Connections),
+			TotalPacketsReceived: stream.TotalPacketsReceived,
+			TotalPacketsSent: stream.TotalPacketsSent,
+			TotalPacketsDropped: stream.TotalPacketsDropped,
+			PacketsPerSecondReceived: stream.PacketsPerSecondReceived,
+			BytesPerSecondReceived: stream.BytesPerSecondReceived,
+			TotalDatagramsLost: stream.TotalDatagramsLost,
+			TotalDatagramsDuplicated: stream.TotalDatagramsDuplicated,
+			TotalSyncLosses: stream.TotalSyncLosses,
+			TotalContinuityErrors: stream.TotalContinuityErrors,
+			TotalTransportErrors: stream.TotalTransportErrors,
+			TotalScrambledPackets: stream.TotalScrambledPackets,
+			TotalPidTimeouts: stream.TotalPidTimeouts,
+			TotalPcrErrors: stream.TotalPcrErrors,
+			Pids: stream.Pids,
+			PcrBitrate: stream.Pcr.Bitrate,
+			PcrInterval: milliseconds(stream.Pcr.Interval),
+			PcrMaxInterval: milliseconds(stream.Pcr.MaxInterval),
+			PcrJitter: milliseconds(stream.Pcr.Jitter),
+		}
+	}
 	
 	writer.Header().Add("Content-Type", "application/json")
 	response, err := json.Marshal(&stats)
@@ -135,31 +208,130 @@ func (api *statisticsApi) ServeHTTP(writer http.ResponseWriter, request *http.Re
 	}
 }
 
+// StateSource is an upstream source that can report its connection state.
+// It is implemented by Client and Ingest.
+type StateSource interface {
+	// Connected returns true if the source is delivering data.
+	Connected() bool
+}
+
+// RemoteSource is a StateSource with multiple upstream URLs,
+// that can report the health of each of them.
+// It is implemented by Client.
+type RemoteSource interface {
+	StateSource
+	// Remotes returns a snapshot of the health of all upstream URLs.
+	Remotes() []RemoteState
+}
+
+// DormantSource is a StateSource that only connects when it is needed.
+// It is implemented by Client.
+type DormantSource interface {
+	StateSource
+	// Dormant returns true if the source is waiting for viewers before it connects.
+	Dormant() bool
+}
+
 // StreamStatApi provides an API for checking stream availability.
 // The HTTP handler returns status code 200 if a stream is connected
 // and 404 if not.
 type streamStateApi struct {
-	client *Client
+	client StateSource
 }
 
 // NewStreamStateApi creates a new stream status API object,
 // serving the "connected" status of a stream connection.
-func NewStreamStateApi(client *Client) http.Handler {
+func NewStreamStateApi(client StateSource) http.Handler {
 	return &streamStateApi{
 		client: client,
 	}
 }
 
 // ServeHTTP is the http handler method.
-// It sends back "200 ok" if the stream is connected and "404 not found" if not,
-// along with the corresponding HTTP status code.
+// It sends back status code 200 if the stream is connected and 404 if not.
+// On-demand streams that are waiting for viewers are reported as idle, with status code 200.
+// The response is plain text, unless ?details is given. Then it contains
+// the overall state and, if available, the health of each upstream URL as JSON.
 func (stat *streamStateApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Add("Content-Type", "text/plain")
+	var state struct {
+		Status string `json:"status"`
+		Remotes []RemoteState `json:"remotes,omitempty"`
+	}
+	status := http.StatusOK
 	if stat.client.Connected() {
-		writer.WriteHeader(http.StatusOK);
-		writer.Write([]byte("200 ok"))
+		state.Status = "ok"
+	} else if dormant, ok := stat.client.(DormantSource); ok && dormant.Dormant() {
+		state.Status = "idle"
+	} else {
+		state.Status = "offline"
+		status = http.StatusNotFound
+	}
+	
+	if _, details := request.URL.Query()["details"]; !details {
+		writer.Header().Add("Content-Type", "text/plain")
+		writer.WriteHeader(status);
+		if status == http.StatusOK {
+			writer.Write([]byte("200 " + state.Status))
+		} else {
+			writer.Write([]byte("404 not found"))
+		}
+		return
+	}
+	
+	if remotes, ok := stat.client.(RemoteSource); ok {
+		state.Remotes = remotes.Remotes()
+	}
+	
+	writer.Header().Add("Content-Type", "application/json")
+	response, err := json.Marshal(&state)
+	if err == nil {
+		writer.WriteHeader(status);
+		writer.Write(response)
+	} else {
+		writer.WriteHeader(http.StatusInternalServerError);
+		writer.Write([]byte("500 internal server error"))
+		log.Print(err)
+	}
+}
+
+// ProgramSource is a stream that can report the programs it carries.
+// It is implemented by Streamer.
+type ProgramSource interface {
+	// Programs returns a snapshot of the program tables.
+	Programs() ProgramTable
+}
+
+// programApi provides an API for inspecting the programs of a stream.
+type programApi struct {
+	source ProgramSource
+}
+
+// NewProgramApi creates a new program info API object,
+// serving the programs, PIDs and codecs of a stream.
+func NewProgramApi(source ProgramSource) http.Handler {
+	return &programApi{
+		source: source,
+	}
+}
+
+// ServeHTTP is the http handler method.
+// It sends back the program tables as JSON, with status code 200,
+// or status code 404 if no PAT has been received yet.
+func (api *programApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	table := api.source.Programs()
+	status := http.StatusOK
+	if table.Version < 0 {
+		status = http.StatusNotFound
+	}
+	
+	writer.Header().Add("Content-Type", "application/json")
+	response, err := json.Marshal(&table)
+	if err == nil {
+		writer.WriteHeader(status);
+		writer.Write(response)
 	} else {
-		writer.WriteHeader(http.StatusNotFound);
-		writer.Write([]byte("404 not found"))
+		writer.WriteHeader(http.StatusInternalServerError);
+		writer.Write([]byte("500 internal server error"))
+		log.Print(err)
 	}
 }
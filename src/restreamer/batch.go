@@ -0,0 +1,281 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// BatchSize is the maximum number of packets in a batch
+	BatchSize = 128
+	// BatchQueueScale converts queue sizes in packets to queue sizes in batches.
+	// Batches contain at least as many packets as a typical UDP datagram,
+	// so a queue still holds at least the configured number of packets.
+	BatchQueueScale = 7
+	// PacketReaderLock is the number of sync bytes in a row that are needed to acquire sync
+	PacketReaderLock = 5
+	// PacketReaderLoss is the number of corrupted sync bytes in a row after which sync is lost
+	PacketReaderLoss = 2
+)
+
+// packetStrides are the supported packet sizes, in the order they are tried
+var packetStrides = [...]int{PacketSize, M2tsPacketSize, RsPacketSize}
+
+// batchPool recycles batch memory
+var batchPool = sync.Pool{
+	New: func() interface{} {
+		return &Batch{
+			Packets: make([]Packet, 0, BatchSize),
+			data: make([]byte, BatchSize * PacketSize),
+		}
+	},
+}
+
+// Batch is a group of consecutive TS packets that share one block of memory.
+//
+// Batches are reference counted: Each consumer that keeps a batch must call
+// Retain() before passing it on and Release() when done with it.
+// When the last reference is released, the memory is recycled,
+// so packets must not be accessed after that.
+type Batch struct {
+	// Packets are the packets in the batch, in order.
+	// They are stored back to back, see Bytes().
+	Packets []Packet
+	// data is the backing memory
+	data []byte
+	// refs is the reference count
+	refs int32
+}
+
+// NewBatch returns an empty batch from the pool, with a reference count of 1.
+func NewBatch() *Batch {
+	batch := batchPool.Get().(*Batch)
+	batch.Packets = batch.Packets[:0]
+	batch.refs = 1
+	return batch
+}
+
+// BatchQueueSize converts a queue size in packets to a queue size in batches.
+func BatchQueueSize(packets uint) int {
+	size := int(packets / BatchQueueScale)
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// Len returns the number of packets in the batch.
+func (batch *Batch) Len() int {
+	return len(batch.Packets)
+}
+
+// Full returns true if no more packets can be appended.
+func (batch *Batch) Full() bool {
+	return len(batch.Packets) >= BatchSize
+}
+
+// Append copies a packet to the end of the batch.
+// Returns false if the batch is full.
+func (batch *Batch) Append(packet Packet) bool {
+	if batch.Full() {
+		return false
+	}
+	start := len(batch.Packets) * PacketSize
+	copy(batch.data[start:start + PacketSize], packet)
+	batch.Packets = append(batch.Packets, Packet(batch.data[start:start + PacketSize]))
+	return true
+}
+
+// Bytes returns the contents of all packets as one block of memory.
+func (batch *Batch) Bytes() []byte {
+	return batch.data[:len(batch.Packets) * PacketSize]
+}
+
+// Retain adds a reference.
+func (batch *Batch) Retain() {
+	atomic.AddInt32(&batch.refs, 1)
+}
+
+// Release drops a reference, recycling the batch when it was the last one.
+func (batch *Batch) Release() {
+	if atomic.AddInt32(&batch.refs, -1) == 0 {
+		batchPool.Put(batch)
+	}
+}
+
+// PacketReader reads TS packets in batches.
+//
+// Data is read in large chunks directly into pooled batch memory,
+// and split into packets at sync byte boundaries.
+//
+// Sync is acquired when PacketReaderLock sync bytes are found at a fixed
+// stride, which also determines the packet format: Plain 188 byte TS packets,
+// 192 byte M2TS packets with a timecode prefix or 204 byte packets with
+// Reed-Solomon parity. All of them are delivered as 188 byte TS packets.
+//
+// A packet with a corrupted sync byte is dropped. When PacketReaderLoss
+// corrupted sync bytes occur in a row, sync is lost and acquired again.
+type PacketReader struct {
+	// reader is the input stream
+	reader io.Reader
+	// carry holds data that was left over from the previous read
+	carry []byte
+	// skip is the number of bytes to discard before the next packet,
+	// if the stride of the last packet reached beyond the data read
+	skip int
+	// stride is the detected packet size, or 0 if not in sync
+	stride int
+	// bad is the number of consecutive corrupted sync bytes
+	bad int
+	// stats is the statistics collector that is notified of sync losses
+	stats Collector
+	// err is a read error that is returned with the next call,
+	// after the packets that came with it have been delivered
+	err error
+}
+
+// NewPacketReader creates a packet reader on top of an input stream.
+func NewPacketReader(reader io.Reader) *PacketReader {
+	return &PacketReader{
+		reader: reader,
+		carry: make([]byte, 0, PacketReaderLock * RsPacketSize),
+		stats: &DummyCollector{},
+	}
+}
+
+// SetCollector assigns a stats collector
+func (reader *PacketReader) SetCollector(stats Collector) {
+	reader.stats = stats
+}
+
+// Stride returns the size of the packets in the input stream,
+// or 0 if sync has not been acquired yet.
+func (reader *PacketReader) Stride() int {
+	return reader.stride
+}
+
+// ReadBatch reads the next batch of packets.
+//
+// It returns as soon as at least one complete packet is available,
+// so no latency is added. The batch must be released by the caller.
+func (reader *PacketReader) ReadBatch() (*Batch, error) {
+	if reader.err != nil {
+		return nil, reader.err
+	}
+	
+	batch := NewBatch()
+	length := copy(batch.data, reader.carry)
+	reader.carry = reader.carry[:0]
+	for {
+		count, err := reader.reader.Read(batch.data[length:])
+		length += count
+		rest := reader.split(batch, length)
+		if batch.Len() > 0 {
+			reader.carry = append(reader.carry, batch.data[rest:length]...)
+			reader.err = err
+			return batch, nil
+		}
+		if err != nil {
+			batch.Release()
+			return nil, err
+		}
+		// no complete packet yet, keep the rest and wait for more
+		length = copy(batch.data, batch.data[rest:length])
+	}
+}
+
+// split finds packets in the first length bytes of the batch memory and
+// moves them together, normalised to 188 bytes. Returns the offset of the
+// first byte that has not been processed yet.
+func (reader *PacketReader) split(batch *Batch, length int) int {
+	data := batch.data
+	offset := reader.skip
+	reader.skip = 0
+	// where to search for sync when it is lost: right after the last good packet
+	resume := offset
+	for {
+		if offset > length {
+			reader.skip = offset - length
+			return length
+		}
+		if reader.stride == 0 {
+			start, stride := findSync(data[offset:length], PacketReaderLock)
+			offset += start
+			if stride == 0 {
+				return offset
+			}
+			reader.stride = stride
+		}
+		if offset + PacketSize > length {
+			return offset
+		}
+		if data[offset] != SyncByte {
+			reader.bad++
+			if reader.bad >= PacketReaderLoss {
+				// out of sync, start over where the trouble began
+				reader.stride = 0
+				reader.bad = 0
+				reader.stats.SyncLost()
+				offset = resume
+				continue
+			}
+		} else {
+			reader.bad = 0
+			resume = offset + PacketSize
+			start := len(batch.Packets) * PacketSize
+			if start != offset {
+				copy(data[start:start + PacketSize], data[offset:offset + PacketSize])
+			}
+			batch.Packets = append(batch.Packets, Packet(data[start:start + PacketSize]))
+		}
+		offset += reader.stride
+	}
+}
+
+// findSync searches for count sync bytes in a row, at one of the supported packet strides.
+// Returns the offset of the first sync byte and the stride.
+// If no sync was found, the stride is 0 and the offset is where the search should
+// be continued when more data is available.
+func findSync(data []byte, count int) (int, int) {
+	for offset := 0; offset < len(data); offset++ {
+		if data[offset] != SyncByte {
+			continue
+		}
+		undecided := false
+		for _, stride := range packetStrides {
+			if offset + (count - 1) * stride >= len(data) {
+				// not enough data to tell yet
+				undecided = true
+				continue
+			}
+			synced := true
+			for i := 1; i < count && synced; i++ {
+				synced = data[offset + i * stride] == SyncByte
+			}
+			if synced {
+				return offset, stride
+			}
+		}
+		if undecided {
+			return offset, 0
+		}
+	}
+	return len(data), 0
+}
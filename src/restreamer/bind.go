@@ -0,0 +1,164 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"net"
+	"errors"
+	"strings"
+	"runtime"
+	"syscall"
+)
+
+const (
+	// soBindToDeviceLinux is SO_BINDTODEVICE on Linux.
+	// Not all platforms define this in the syscall package.
+	soBindToDeviceLinux = 25
+)
+
+var (
+	// ErrInvalidBind is thrown when the bind address is not an IP address.
+	ErrInvalidBind = errors.New("restreamer: invalid bind address")
+	// ErrNoInterfaceAddress is thrown when an interface can't be bound to
+	// because it has no IP address (only on platforms without SO_BINDTODEVICE).
+	ErrNoInterfaceAddress = errors.New("restreamer: interface has no usable address")
+)
+
+// Binding selects the local address and network interface that outgoing
+// connections are made from. This allows sending upstream traffic through
+// a dedicated network, instead of the default route.
+type Binding struct {
+	// Bind is the local IP address for outgoing connections
+	Bind string `json:"bind"`
+	// Interface is the name of the network interface for outgoing connections
+	// and multicast group joins
+	Interface string `json:"interface"`
+}
+
+// Inherit returns a copy of the binding where unset values are taken from defaults.
+func (binding Binding) Inherit(defaults Binding) Binding {
+	if binding.Bind == "" {
+		binding.Bind = defaults.Bind
+	}
+	if binding.Interface == "" {
+		binding.Interface = defaults.Interface
+	}
+	return binding
+}
+
+// Apply configures a dialer to connect from the bound address and interface.
+//
+// On Linux, the socket is tied to the interface with SO_BINDTODEVICE,
+// so the routing table of the interface is used. Elsewhere, the first
+// address of the interface is used as the local address instead.
+//
+// Only TCP connections are bound, other networks are dialed as usual.
+func (binding Binding) Apply(dialer *net.Dialer) error {
+	var local net.IP
+	if binding.Bind != "" {
+		local = net.ParseIP(binding.Bind)
+		if local == nil {
+			return ErrInvalidBind
+		}
+	}
+	if binding.Interface != "" {
+		iface, err := net.InterfaceByName(binding.Interface)
+		if err != nil {
+			return err
+		}
+		if runtime.GOOS == "linux" {
+			name := iface.Name
+			dialer.Control = func(network, address string, raw syscall.RawConn) error {
+				if !strings.HasPrefix(network, "tcp") {
+					return nil
+				}
+				var err error
+				cerr := raw.Control(func(fd uintptr) {
+					err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, soBindToDeviceLinux, name)
+				})
+				if cerr != nil {
+					return cerr
+				}
+				return err
+			}
+		} else if local == nil {
+			local = interfaceAddress(iface)
+			if local == nil {
+				return ErrNoInterfaceAddress
+			}
+		}
+	}
+	if local != nil {
+		dialer.LocalAddr = &net.TCPAddr{
+			IP: local,
+		}
+	}
+	return nil
+}
+
+// MulticastInterface returns the interface for joining multicast groups.
+// This is the configured interface, or the interface that owns the bind address.
+// Returns nil if neither is set, to let the OS choose.
+func (binding Binding) MulticastInterface() (*net.Interface, error) {
+	if binding.Interface != "" {
+		return net.InterfaceByName(binding.Interface)
+	}
+	if binding.Bind == "" {
+		return nil, nil
+	}
+	local := net.ParseIP(binding.Bind)
+	if local == nil {
+		return nil, ErrInvalidBind
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(local) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, ErrNoInterfaceAddress
+}
+
+// interfaceAddress returns the first IPv4 address of an interface,
+// or the first IPv6 address if there is none.
+func interfaceAddress(iface *net.Interface) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var found net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			if ipnet.IP.To4() != nil {
+				return ipnet.IP
+			}
+			if found == nil {
+				found = ipnet.IP
+			}
+		}
+	}
+	return found
+}
@@ -22,9 +22,16 @@ import (
 	"fmt"
 	"time"
 	"errors"
+	"strconv"
+	"strings"
+	"sync"
 	"net"
 	"net/http"
 	"net/url"
+	"math/rand"
+	"mime"
+	"bufio"
+	"context"
 )
 
 const (
@@ -40,19 +47,42 @@ const (
 	eventClientStarted = "started"
 	eventClientStopped = "stopped"
 	eventClientOpenPath = "open_path"
+	eventClientOpenFile = "open_file"
+	eventClientOpenExec = "open_exec"
 	eventClientOpenHttp = "open_http"
 	eventClientOpenTcp = "open_tcp"
 	eventClientOpenDomain = "open_domain"
+	eventClientOpenUdp = "open_udp"
+	eventClientOpenRtp = "open_rtp"
+	eventClientOpenHls = "open_hls"
+	eventClientListenTcp = "listen_tcp"
 	eventClientPull = "pull"
 	eventClientClosed = "closed"
-	eventClientTimerStop = "timer_stop"
-	eventClientTimerStopped = "timer_stopped"
-	eventClientNoPacket = "nopacket"
-	eventClientTimerKill = "killed"
 	eventClientReadTimeout = "read_timeout"
+	eventClientProbe = "probe"
+	eventClientSwitch = "switch"
+	eventClientDemand = "demand"
+	eventClientIdle = "idle"
+	eventClientResolve = "resolve"
 	//
 	errorClientConnect = "connect"
+	errorClientUpstream = "upstream"
 	errorClientParse = "parse"
+	errorClientBind = "bind"
+	errorClientResolve = "resolve"
+	errorClientProbe = "probe"
+	//
+	// clientDefaultRedirects is the redirect limit of the standard library
+	clientDefaultRedirects = 10
+	// clientDefaultSyncPackets is the default number of TS packets
+	// that must be received before an upstream is considered connected
+	clientDefaultSyncPackets = 5
+	// clientDefaultResolveInterval is the default time after which
+	// host names are resolved again
+	clientDefaultResolveInterval = 5 * time.Minute
+	// clientSyncBufferSize is the input buffer size, it must be large
+	// enough to hold SyncPackets packets of the largest supported size
+	clientSyncBufferSize = 64 * PacketSize
 )
 
 var (
@@ -70,8 +100,62 @@ var (
 	ErrInvalidResponse = errors.New("restreamer: unsupported response code")
 	// ErrNoUrl is thrown when the list of upstream URLs was empty
 	ErrNoUrl = errors.New("restreamer: no parseable upstream URL")
+	// ErrTooManyRedirects is thrown when an upstream redirected more often than allowed
+	ErrTooManyRedirects = errors.New("restreamer: too many redirects")
+	// ErrInvalidContentType is thrown when an upstream sent a content type that is not allowed
+	ErrInvalidContentType = errors.New("restreamer: unsupported content type")
+	// ErrNoSync is thrown when an upstream does not send a transport stream
+	ErrNoSync = errors.New("restreamer: no transport stream sync")
+)
+
+const (
+	// UpstreamReasonStatus is reported when an upstream returned an unusable HTTP status
+	UpstreamReasonStatus = "status"
+	// UpstreamReasonRedirect is reported when the redirect limit was exceeded
+	UpstreamReasonRedirect = "redirect"
+	// UpstreamReasonContentType is reported when the content type is not allowed
+	UpstreamReasonContentType = "content_type"
+	// UpstreamReasonSync is reported when the data is not a transport stream
+	UpstreamReasonSync = "sync"
+	// UpstreamReasonTimeout is reported when an upstream stopped sending data
+	UpstreamReasonTimeout = "timeout"
+	// UpstreamReasonConnection is reported for all other errors, such as network failures
+	UpstreamReasonConnection = "connection"
 )
 
+// UpstreamError is returned when an upstream could be reached,
+// but its response is not a usable transport stream.
+type UpstreamError struct {
+	// Reason is one of the UpstreamReason constants
+	Reason string
+	// Err is the general error
+	Err error
+	// Detail describes what was received
+	Detail string
+}
+
+func (err *UpstreamError) Error() string {
+	return fmt.Sprintf("%s: %s", err.Err, err.Detail)
+}
+
+func (err *UpstreamError) Unwrap() error {
+	return err.Err
+}
+
+// ErrorReason classifies an upstream error.
+// Returns the reason of an UpstreamError, UpstreamReasonTimeout for ErrReadTimeout,
+// or UpstreamReasonConnection for any other error.
+func ErrorReason(err error) string {
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		return upstream.Reason
+	}
+	if errors.Is(err, ErrReadTimeout) {
+		return UpstreamReasonTimeout
+	}
+	return UpstreamReasonConnection
+}
+
 // ConnectCloser is an interface for objects that support a Connect() and Close() method.
 // Most suitable for self-managed classes that have an 'offline' and 'online' state.
 type ConnectCloser interface {
@@ -109,26 +193,79 @@ func (*DummyConnectCloser) Connect() error {
 //     "client": "1.2.3.4:12" | client ip:port,
 // }
 type Client struct {
-	// connector is a network dialer for TCP, UDP and HTTP
-	connector *net.Dialer
-	// getter is a generic HTTP client
-	getter *http.Client
-	// urls is the URLs to GET (either of them)
-	urls []*url.URL
+	// timeout is the connect timeout
+	timeout time.Duration
+	// tls is the TLS configuration for https upstreams, nil for the defaults
+	tls *TlsLoader
+	// lock protects the remote health information, remotes, resolved,
+	// input, standby, stop, done and linger
+	lock sync.Mutex
+	// configured is the list of upstream URLs from the configuration
+	configured []*remote
+	// remotes is the list of upstream URLs, along with their health.
+	// If Resolve is set, host names are replaced by one remote per address.
+	remotes []*remote
+	// Resolve expands the host name of each remote into its addresses,
+	// so that each address is a separate failover candidate.
+	Resolve bool
+	// ResolveInterval is the time after which host names are resolved again
+	ResolveInterval time.Duration
+	// resolved is the time of the last host name resolution
+	resolved time.Time
 	// response is the HTTP response, including the body reader
 	response *http.Response
 	// input is the input stream (socket)
 	input io.ReadCloser
+	// standby is a connection to a preferred remote, ready to take over
+	standby *connection
 	// Wait is the time before reconnecting a disconnected upstream.
-	// This is a deadline: If a connection (or connection attempt) takes longer
+	// This is a deadline: If a connection has been up for longer
 	// than this duration, a reconnection is attempted immediately.
+	// After a failed attempt, the remote is put on hold for this duration.
+	// On further failures, the delay is doubled each time, up to MaxWait.
 	Wait time.Duration
+	// MaxWait is the upper limit of the reconnect delay for a failing remote.
+	// If it is smaller than Wait, the delay stays constant.
+	MaxWait time.Duration
+	// Jitter is a random variation applied to reconnect delays, as a fraction
+	// of the delay (0..1). It keeps many instances from reconnecting in lockstep.
+	Jitter float64
+	// HoldDown is the time a preferred remote must stream without interruption
+	// while probing, before the client switches back to it from a backup.
+	HoldDown time.Duration
+	// random is the random number source for the jitter and weighted selection.
+	// Protected by lock.
+	random *rand.Rand
 	// ReadTimeout is the timeout for individual packet reads
 	ReadTimeout time.Duration
+	// MaxRedirects is the number of HTTP redirects that are followed
+	MaxRedirects int
+	// ContentTypes is the list of acceptable HTTP content types.
+	// Responses without a content type are always accepted.
+	// If the list is empty, all content types are accepted.
+	ContentTypes []string
+	// SyncPackets is the number of consecutive TS packets that must be
+	// received before an upstream is considered connected.
+	SyncPackets int
+	// OnDemand makes the client connect only while the stream has viewers.
+	// See Demand() and Idle().
+	OnDemand bool
+	// Linger is the time that an on-demand client stays connected
+	// after the last viewer has left.
+	Linger time.Duration
+	// stop is closed to end the current on-demand session, nil if there is none
+	stop chan struct{}
+	// done is closed when the connection loop of the last session has ended
+	done chan struct{}
+	// linger is the timer that runs while an on-demand session has no viewers
+	linger *time.Timer
 	// streamer is the attached packet distributor
 	streamer *Streamer
+	// queue is the packet queue feeding the streamer.
+	// It stays open across reconnects, so connected clients are kept.
+	queue chan *Batch
 	// running is true while the client is streaming into the queue.
-	// Use ReadBool(client.running) to get the current value.
+	// Use LoadBool(&client.running) to get the current value.
 	running AtomicBool
 	// stats is the statistics collector for this client
 	stats Collector
@@ -136,8 +273,8 @@ type Client struct {
 	logger *ModuleLogger
 	// listener is a downstream object that can handle connect/disconnect notifications
 	listener ConnectCloser
-	// queueSize is the size of the input queue
-	queueSize uint
+	// acceptors holds the listening sockets for tcp-listen upstreams, by local address
+	acceptors map[string]*TcpAcceptor
 }
 
 // NewClient constructs a new streaming HTTP client, without connecting the socket yet.
@@ -146,15 +283,22 @@ type Client struct {
 // After a connection has been closed, the client will attempt to reconnect after a
 // configurable delay. This delay is cumulative; if a connection has been up for longer,
 // a reconnect will be attempted immediately.
+// Remotes that fail repeatedly are put on hold with exponential backoff,
+// see MaxWait and Jitter.
+//
+// Remotes are grouped into priority tiers. The client connects to the best
+// tier that is available, choosing randomly by weight inside a tier.
+// While streaming from a backup tier, it keeps probing the preferred remotes
+// and switches back as soon as one of them has been healthy for HoldDown.
 //
 // Arguments:
-//   uris: a list of upstream URIs, used in random order
+//   remotes: a list of upstream URIs with priority and weight
 //   queue: the outgoing packet queue
 //   timeout: the connect timeout
 //   reconnect: the minimal reconnect delay
 //   readtimeout: the read timeout
 //   qsize: the input queue size
-func NewClient(uris []string, streamer *Streamer, timeout uint, reconnect uint, readtimeout uint, qsize uint) (*Client, error) {
+func NewClient(configs []RemoteConfig, streamer *Streamer, timeout uint, reconnect uint, readtimeout uint, qsize uint) (*Client, error) {
 	logger := &ModuleLogger{
 		Logger: &ConsoleLogger{},
 		Defaults: Dict{
@@ -162,57 +306,99 @@ func NewClient(uris []string, streamer *Streamer, timeout uint, reconnect uint,
 		},
 		AddTimestamp: true,
 	}
-	urls := make([]*url.URL, len(uris))
-	count := 0
-	for _, uri := range uris {
-		parsed, err := url.Parse(uri)
-		if err == nil {
-			urls[count] = parsed
-			count++
-		} else {
+	client := Client {
+		// this timeout is only used for establishing connections
+		timeout: time.Duration(timeout) * time.Second,
+		ResolveInterval: clientDefaultResolveInterval,
+		response: nil,
+		input: nil,
+		Wait: time.Duration(reconnect) * time.Second,
+		MaxWait: time.Duration(reconnect) * time.Second,
+		HoldDown: 0,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+		ReadTimeout: time.Duration(readtimeout) * time.Second,
+		MaxRedirects: clientDefaultRedirects,
+		SyncPackets: clientDefaultSyncPackets,
+		streamer: streamer,
+		queue: make(chan *Batch, BatchQueueSize(qsize)),
+		running: AtomicFalse,
+		stats: &DummyCollector{},
+		logger: logger,
+		listener: &DummyConnectCloser{},
+		acceptors: make(map[string]*TcpAcceptor),
+	}
+	for _, config := range configs {
+		parsed, err := url.Parse(config.Url)
+		if err != nil {
 			logger.Log(Dict{
 				"event": eventClientError,
 				"error": errorClientParse,
-				"message": fmt.Sprintf("Error parsing URL %s: %s", uri, err),
+				"message": fmt.Sprintf("Error parsing URL %s: %s", config.Url, err),
+			})
+			continue
+		}
+		weight := config.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		remote := &remote{
+			url: parsed,
+			index: len(client.configured),
+			priority: config.Priority,
+			weight: weight,
+			credentials: config.Credentials,
+			command: config.Command,
+			binding: config.Binding,
+		}
+		err = client.prepare(remote)
+		if err != nil {
+			logger.Log(Dict{
+				"event": eventClientError,
+				"error": errorClientBind,
+				"url": config.Url,
+				"bind": config.Bind,
+				"interface": config.Interface,
+				"message": fmt.Sprintf("Error binding %s to %s %s: %s", config.Url, config.Bind, config.Interface, err),
 			})
+			continue
 		}
+		client.configured = append(client.configured, remote)
 	}
-	if count < 1 {
+	if len(client.configured) < 1 {
 		return nil, ErrNoUrl
 	}
-	// this timeout is only used for establishing connections
-	toduration := time.Duration(timeout) * time.Second
-	dialer := &net.Dialer{
-		Timeout: toduration,
+	client.remotes = client.configured
+	return &client, nil
+}
+
+// prepare creates the dialer and HTTP client of a remote.
+// Each remote has its own, because they can be bound and resolved differently.
+func (client *Client) prepare(remote *remote) error {
+	remote.connector = &net.Dialer{
+		Timeout: client.timeout,
 		KeepAlive: 0,
 		DualStack: true,
 	}
-	transport := &http.Transport{
+	err := remote.binding.Apply(remote.connector)
+	if err != nil {
+		return err
+	}
+	remote.transport = &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
-		Dial: dialer.Dial,
+		Dial: remote.dial,
 		DisableKeepAlives: true,
-		TLSHandshakeTimeout: toduration,
-		ResponseHeaderTimeout: toduration,
-		ExpectContinueTimeout: toduration,
+		TLSHandshakeTimeout: client.timeout,
+		ResponseHeaderTimeout: client.timeout,
+		ExpectContinueTimeout: client.timeout,
 	}
-	client := Client {
-		connector: dialer,
-		getter: &http.Client{
-			Transport: transport,
-		},
-		urls: urls,
-		response: nil,
-		input: nil,
-		Wait: time.Duration(reconnect) * time.Second,
-		ReadTimeout: time.Duration(readtimeout) * time.Second,
-		streamer: streamer,
-		running: AtomicFalse,
-		stats: &DummyCollector{},
-		logger: logger,
-		listener: &DummyConnectCloser{},
-		queueSize: qsize,
+	if client.tls != nil {
+		remote.transport.TLSClientConfig = client.tls.ClientConfig()
 	}
-	return &client, nil
+	remote.getter = &http.Client{
+		Transport: remote.transport,
+		CheckRedirect: client.redirect,
+	}
+	return nil
 }
 
 // SetLogger assigns a backing logger, while keeping the current module defaults.
@@ -225,6 +411,20 @@ func (client *Client) SetCollector(stats Collector) {
 	client.stats = stats
 }
 
+// SetTls assigns TLS settings for https upstreams.
+// Certificates are reloaded by the loader when they change.
+func (client *Client) SetTls(loader *TlsLoader) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	client.tls = loader
+	for _, remote := range client.configured {
+		remote.transport.TLSClientConfig = loader.ClientConfig()
+	}
+	for _, remote := range client.remotes {
+		remote.transport.TLSClientConfig = loader.ClientConfig()
+	}
+}
+
 // SetStateListener adds a listener that will be notified when the client
 // connection is closed or reconnected.
 //
@@ -238,18 +438,100 @@ func (client *Client) SetStateListener(listener ConnectCloser) {
 // This will cause the streaming thread to fail and try to reestablish
 // a connection (unless reconnects are disabled).
 func (client *Client) Close() error {
-	if client.input != nil {
-		err := client.input.Close()
+	client.lock.Lock()
+	input := client.input
+	client.lock.Unlock()
+	if input != nil {
+		err := input.Close()
 		return err
 	}
 	return ErrNoConnection
 }
 
-// Connect spawns the connection loop.
+// Connect starts the streamer and spawns the connection loop.
+// If OnDemand is set, the connection loop is only started by Demand().
 //
 // Do not call this method multiple times!
 func (client *Client) Connect() {
-	go client.loop()
+	go client.streamer.Stream(client.queue)
+	if !client.OnDemand {
+		go client.loop(nil)
+	}
+}
+
+// Demand starts an on-demand session, or keeps the current one alive.
+// Satisfies the DemandListener interface.
+func (client *Client) Demand() {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	
+	if client.linger != nil {
+		client.linger.Stop()
+		client.linger = nil
+	}
+	if client.stop == nil {
+		client.logger.Log(Dict{
+			"event": eventClientDemand,
+			"message": "Stream requested, connecting",
+		})
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		previous := client.done
+		client.stop = stop
+		client.done = done
+		go func() {
+			// the last session may still be shutting down
+			if previous != nil {
+				<-previous
+			}
+			client.loop(stop)
+			close(done)
+		}()
+	}
+}
+
+// Idle ends the current on-demand session after Linger.
+// Satisfies the DemandListener interface.
+func (client *Client) Idle() {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	
+	if client.stop != nil && client.linger == nil {
+		var timer *time.Timer
+		timer = time.AfterFunc(client.Linger, func() {
+			client.lock.Lock()
+			// a viewer may have come back while we were waiting for the lock
+			if client.linger != timer {
+				client.lock.Unlock()
+				return
+			}
+			client.linger = nil
+			client.logger.Log(Dict{
+				"event": eventClientIdle,
+				"linger": client.Linger.Seconds(),
+				"message": fmt.Sprintf("No viewers for %0.0f seconds, disconnecting", client.Linger.Seconds()),
+			})
+			close(client.stop)
+			client.stop = nil
+			standby := client.standby
+			client.standby = nil
+			client.lock.Unlock()
+			
+			if standby != nil {
+				standby.input.Close()
+			}
+			client.Close()
+		})
+		client.linger = timer
+	}
+}
+
+// Dormant returns true if the client is waiting for viewers
+// before it connects.
+func (client *Client) Dormant() bool {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.OnDemand && client.stop == nil
 }
 
 // StatusCode returns the HTTP status code, or 0 if not connected.
@@ -274,252 +556,962 @@ func (client *Client) Connected() bool {
 	return LoadBool(&client.running)
 }
 
+// Remotes returns a snapshot of the health of all upstream URLs.
+func (client *Client) Remotes() []RemoteState {
+	client.lock.Lock()
+	states := make([]RemoteState, len(client.remotes))
+	for i, remote := range client.remotes {
+		states[i] = remote.state()
+	}
+	client.lock.Unlock()
+	return states
+}
+
+// backoff returns the waiting time after a number of consecutive failures.
+// The delay starts at Wait and doubles with each failure, up to MaxWait.
+// Jitter is applied on top.
+func (client *Client) backoff(failures uint) time.Duration {
+	delay := client.Wait
+	for i := uint(1); i < failures && delay < client.MaxWait; i++ {
+		delay *= 2
+	}
+	if client.Jitter > 0 {
+		delay += time.Duration(float64(delay) * client.Jitter * (2 * client.random.Float64() - 1))
+	}
+	// the cap is a hard limit, jitter can only shorten the delay there
+	if delay > client.MaxWait && client.MaxWait >= client.Wait {
+		delay = client.MaxWait
+	}
+	return delay
+}
+
+// resolve expands the host names of the configured remotes into their
+// addresses, if Resolve is set and the last resolution is older than
+// ResolveInterval.
+//
+// Each address becomes a remote of its own, with its own health.
+// Remotes keep their health as long as their address is still returned.
+// If a host name can't be resolved, the previous addresses are kept,
+// or the configured remote is used as it is.
+func (client *Client) resolve() {
+	if !client.Resolve {
+		return
+	}
+	client.lock.Lock()
+	due := client.resolved.IsZero() || time.Since(client.resolved) >= client.ResolveInterval
+	client.lock.Unlock()
+	if !due {
+		return
+	}
+	
+	expanded := make([]*remote, 0, len(client.configured))
+	for _, configured := range client.configured {
+		if !resolvable(configured.url) {
+			expanded = append(expanded, configured)
+			continue
+		}
+		host := configured.url.Hostname()
+		addresses, err := client.lookup(host)
+		client.lock.Lock()
+		if err != nil {
+			client.logger.Log(Dict{
+				"event": eventClientError,
+				"error": errorClientResolve,
+				"url": configured.url.String(),
+				"message": fmt.Sprintf("Error resolving %s: %s", host, err),
+			})
+			previous := client.resolvedFrom(configured)
+			if len(previous) == 0 {
+				previous = append(previous, configured)
+			}
+			expanded = append(expanded, previous...)
+		} else {
+			client.logger.Log(Dict{
+				"event": eventClientResolve,
+				"url": configured.url.String(),
+				"addresses": addresses,
+				"message": fmt.Sprintf("Resolved %s to %s.", host, strings.Join(addresses, ", ")),
+			})
+			previous := client.resolvedFrom(configured)
+			for _, address := range addresses {
+				expanded = append(expanded, client.expand(configured, address, previous))
+			}
+		}
+		client.lock.Unlock()
+	}
+	
+	client.lock.Lock()
+	client.remotes = expanded
+	client.resolved = time.Now()
+	client.lock.Unlock()
+}
+
+// lookup resolves a host name into its addresses, within the connect timeout.
+func (client *Client) lookup(host string) ([]string, error) {
+	ctx := context.Background()
+	if client.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.timeout)
+		defer cancel()
+	}
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+// resolvedFrom returns the current remotes that were resolved from configured.
+// Must be called with the lock held.
+func (client *Client) resolvedFrom(configured *remote) []*remote {
+	var remotes []*remote
+	for _, remote := range client.remotes {
+		if remote.origin == configured {
+			remotes = append(remotes, remote)
+		}
+	}
+	return remotes
+}
+
+// expand returns the remote for an address of a configured remote.
+// If it is among the previous remotes, that one is returned with its health,
+// otherwise a new one is created.
+// Must be called with the lock held.
+func (client *Client) expand(configured *remote, address string, previous []*remote) *remote {
+	for _, remote := range previous {
+		if remote.address == address {
+			return remote
+		}
+	}
+	remote := &remote{
+		url: configured.url,
+		index: configured.index,
+		priority: configured.priority,
+		weight: configured.weight,
+		credentials: configured.credentials,
+		command: configured.command,
+		binding: configured.binding,
+		origin: configured,
+		address: address,
+	}
+	// the binding was already applied successfully to the configured remote
+	client.prepare(remote)
+	return remote
+}
+
+// resolvable returns true if the URL refers to an upstream host by name,
+// that we connect to.
+func resolvable(url *url.URL) bool {
+	switch url.Scheme {
+		case "http", "https", "hls+http", "hls+https", "tcp":
+			return url.Hostname() != "" && net.ParseIP(url.Hostname()) == nil
+		default:
+			return false
+	}
+}
+
+// pick selects the remote that should be tried next.
+//
+// A remote that is on standby is always taken. Otherwise, the best priority
+// tier among the remotes that are not on hold is selected, and one remote
+// from that tier is chosen randomly according to the weights.
+// Addresses resolved from the same configured remote share its weight equally.
+// If all remotes are on hold, the one that is available first is returned.
+func (client *Client) pick() *remote {
+	now := time.Now()
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	
+	if client.standby != nil {
+		return client.standby.remote
+	}
+	
+	var tier []*remote
+	for _, remote := range client.remotes {
+		if remote.next.After(now) {
+			continue
+		}
+		if len(tier) > 0 && remote.priority < tier[0].priority {
+			tier = tier[:0]
+		}
+		if len(tier) == 0 || remote.priority == tier[0].priority {
+			tier = append(tier, remote)
+		}
+	}
+	if len(tier) > 0 {
+		// the addresses resolved from a configured remote share its weight
+		var groups [][]*remote
+		total := uint(0)
+		for _, candidate := range tier {
+			found := false
+			for i, group := range groups {
+				if group[0].configured() == candidate.configured() {
+					groups[i] = append(group, candidate)
+					found = true
+					break
+				}
+			}
+			if !found {
+				groups = append(groups, []*remote{candidate})
+				total += candidate.weight
+			}
+		}
+		choice := uint(client.random.Int63n(int64(total)))
+		for _, group := range groups {
+			if choice < group[0].weight {
+				return group[client.random.Intn(len(group))]
+			}
+			choice -= group[0].weight
+		}
+	}
+	
+	best := client.remotes[0]
+	for _, remote := range client.remotes[1:] {
+		if remote.better(best) {
+			best = remote
+		}
+	}
+	return best
+}
+
+// preferred returns the remote that should be probed while streaming from current,
+// or nil if there is no remote with a better priority.
+func (client *Client) preferred(current *remote) *remote {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	var best *remote
+	for _, remote := range client.remotes {
+		if remote.priority < current.priority && (best == nil || remote.better(best)) {
+			best = remote
+		}
+	}
+	return best
+}
+
+// finish updates the health of a remote after a connection has ended.
+//
+// A connection that streamed for longer than Wait counts as a success,
+// and the remote may be reconnected immediately. Anything shorter
+// counts as a failure and puts the remote on hold.
+func (client *Client) finish(remote *remote, err error) {
+	now := time.Now()
+	client.lock.Lock()
+	if remote.connected && now.Sub(remote.lastConnect) >= client.Wait {
+		remote.failures = 0
+		remote.next = now
+	} else {
+		remote.failures++
+		remote.lastFailure = now
+		remote.next = now.Add(client.backoff(remote.failures))
+	}
+	if err != nil {
+		remote.lastError = err.Error()
+		remote.lastErrorType = ErrorReason(err)
+	}
+	remote.connected = false
+	client.lock.Unlock()
+}
+
 // loop tries to connect and loops until successful.
 // If client.Wait is 0, it only tries once.
-func (client *Client) loop() {
+// An on-demand session ends when stop is closed. Without a session,
+// stop is nil and the loop runs forever.
+func (client *Client) loop(stop <-chan struct{}) {
 	first := true
 	
-	// deadline to avoid a busy loop, but still allow an immediate reconnect on loss
-	deadline := time.Now().Add(client.Wait)
-	
-	next := 0
-	
-	for first || client.Wait != 0 {
+	for (first || client.Wait != 0) && !stopped(stop) {
+		// look up the addresses of the remotes again, if it is time
+		client.resolve()
+		// pick the healthiest server
+		remote := client.pick()
+		
 		if first {
 			// there is only one first attempt
 			first = false
 		} else {
-			// sleep if this is not the first attempt,
-			// but sleep only if the deadline has not been reached yet
-			now := time.Now()
-			if now.Before(deadline) {
-				wait := deadline.Sub(now)
+			// sleep if the remote is still on hold
+			client.lock.Lock()
+			wait := remote.next.Sub(time.Now())
+			client.lock.Unlock()
+			if wait > 0 {
 				client.logger.Log(Dict{
 					"event": eventClientRetry,
 					"retry": wait.Seconds(),
+					"url": remote.url.String(),
+					"address": remote.address,
 					"message": fmt.Sprintf("Retrying after %0.0f seconds.", wait.Seconds()),
 				})
-				time.Sleep(wait)
+				select {
+					case <-time.After(wait):
+					case <-stop:
+						return
+				}
 			}
-			// update the deadline
-			deadline = time.Now().Add(client.Wait)
 		}
 		
-		// pick the next server
-		url := client.urls[next]
-		next = (next + 1) % len(client.urls)
-		
 		// connect
 		client.logger.Log(Dict{
 			"event": eventClientConnecting,
-			"url": url.String(),
+			"url": remote.url.String(),
+			"address": remote.address,
 		})
-		err := client.start(url)
+		err := client.start(remote, stop)
+		if stopped(stop) {
+			// disconnected on purpose, this is not a failure
+			client.lock.Lock()
+			remote.connected = false
+			client.lock.Unlock()
+			return
+		}
 		if err != nil {
 			// not handled, log
+			kind := errorClientConnect
+			if reason := ErrorReason(err); reason != UpstreamReasonConnection && reason != UpstreamReasonTimeout {
+				kind = errorClientUpstream
+			}
 			client.logger.Log(Dict{
 				"event": eventClientError,
-				"error": errorClientConnect,
-				"url": url.String(),
+				"error": kind,
+				"reason": ErrorReason(err),
+				"url": remote.url.String(),
+				"address": remote.address,
 				"message": err.Error(),
 			})
 		}
+		client.finish(remote, err)
 		
 		if client.Wait == 0 {
 			client.logger.Log(Dict{
 				"event": eventClientOffline,
-				"url": url.String(),
+				"url": remote.url.String(),
+				"address": remote.address,
 				"message": "Reconnecting disabled. Stream will stay offline.",
 			})
 		}
 	}
+	
+	// no more packets, shut down the streamer
+	// on-demand sessions keep it running for the next one
+	if stop == nil {
+		close(client.queue)
+	}
 }
 
-// start connects the socket, sends the HTTP request and starts streaming.
-func (client *Client) start(url *url.URL) error {
-	/*client.logger.Log(Dict{
-		"event": eventClientDebug,
-		"debug": Dict{
-			"timeout": client.Timeout,
-		},
-		"url": url.String(),
-	})*/
-	if client.input == nil {
-		switch url.Scheme {
-		// handled by os.Open
-		case "file":
-			client.logger.Log(Dict{
-				"event": eventClientOpenPath,
-				"path": url.Path,
-				"message": fmt.Sprintf("Opening %s.", url.Path),
-			})
-			file, err := os.Open(url.Path)
-			if err != nil {
-				return err
-			}
-			client.input = file
-		// both handled by http.Client
-		case "http":
-			fallthrough
-		case "https":
-			client.logger.Log(Dict{
-				"event": eventClientOpenHttp,
-				"url": url.String(),
-				"message": fmt.Sprintf("Connecting to %s.", url),
-			})
-			request, err := http.NewRequest("GET", url.String(), nil)
-			if err != nil {
-				return err
-			}
-			response, err := client.getter.Do(request)
-			if err != nil {
-				return err
-			}
-			client.response = response
-			client.input = response.Body
-		// handled directly by net.Dialer
-		case "tcp":
-			client.logger.Log(Dict{
-				"event": eventClientOpenTcp,
-				"host": url.Host,
-				"message": fmt.Sprintf("Connecting TCP socket to %s.", url.Host),
-			})
-			conn, err := client.connector.Dial(url.Scheme, url.Host)
-			if err != nil {
-				return err
-			}
-			client.input = conn
-		// handled by net.Dialer too, but different URL semantics
-		case "unix":
-			fallthrough
-		case "unixgram":
-			fallthrough
-		case "unixpacket":
-			client.logger.Log(Dict{
-				"event": eventClientOpenDomain,
-				"path": url.Path,
-				"message": fmt.Sprintf("Connecting domain socket to %s.", url.Path),
-			})
-			conn, err := client.connector.Dial(url.Scheme, url.Path)
-			if err != nil {
-				return err
+// stoppable returns a context that is cancelled when stop is closed,
+// or when the returned cancel function is called.
+func stoppable(stop <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if stop != nil {
+		go func() {
+			select {
+				case <-stop:
+					cancel()
+				case <-ctx.Done():
 			}
-			client.input = conn
+		}()
+	}
+	return ctx, cancel
+}
+
+// stopped returns true if stop has been closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+		case <-stop:
+			return true
 		default:
-			return ErrInvalidProtocol
+			return false
+	}
+}
+
+// start connects the socket, sends the HTTP request and starts streaming.
+// If the remote is on standby, its connection is taken over instead.
+// Streaming is not started if the session was stopped while connecting.
+func (client *Client) start(remote *remote, stop <-chan struct{}) error {
+	url := remote.url
+	
+	client.lock.Lock()
+	if client.input != nil {
+		client.lock.Unlock()
+		return ErrAlreadyConnected
+	}
+	standby := client.standby
+	client.standby = nil
+	client.lock.Unlock()
+	
+	// closing stop aborts connecting and ends the stream
+	ctx, cancel := stoppable(stop)
+	defer cancel()
+	
+	var input io.ReadCloser
+	var response *http.Response
+	if standby != nil && standby.remote == remote {
+		client.logger.Log(Dict{
+			"event": eventClientSwitch,
+			"url": url.String(),
+			"address": remote.address,
+			"message": fmt.Sprintf("Switching over to preferred stream %s.", remote),
+		})
+		input = standby.input
+		response = standby.response
+		// the probe is live now, report to the stream
+		if reader, ok := input.(*RtpReader); ok {
+			reader.SetCollector(client.stats)
 		}
-		
-		// start streaming
-		StoreBool(&client.running, true)
+	} else {
+		if standby != nil {
+			standby.input.Close()
+		}
+		var err error
+		input, response, err = client.open(ctx, remote, client.stats)
+		if err != nil {
+			if stopped(stop) {
+				// aborted, the remote is not to blame
+				return nil
+			}
+			return err
+		}
+	}
+	client.lock.Lock()
+	if stopped(stop) {
+		client.lock.Unlock()
+		input.Close()
+		return nil
+	}
+	client.input = input
+	client.response = response
+	client.lock.Unlock()
+	
+	// keep looking for a better remote while this one is streaming
+	done := make(chan struct{})
+	if client.Wait != 0 {
+		go client.probe(remote, done)
+	}
+	
+	// start streaming
+	StoreBool(&client.running, true)
+	client.logger.Log(Dict{
+		"event": eventClientPull,
+		"url": url.String(),
+		"address": remote.address,
+		"message": fmt.Sprintf("Starting to pull stream %s.", remote),
+	})
+	err := client.pull(remote)
+	client.logger.Log(Dict{
+		"event": eventClientClosed,
+		"url": url.String(),
+		"address": remote.address,
+		"message": fmt.Sprintf("Socket for stream %s closed", remote),
+	})
+	close(done)
+	
+	// cleanup
+	client.Close()
+	client.lock.Lock()
+	client.input = nil
+	client.response = nil
+	if client.standby != nil {
+		// closed for switching over to a preferred remote, not an error
+		err = nil
+	}
+	client.lock.Unlock()
+	
+	return err
+}
+
+// open connects to an upstream and returns the input stream,
+// and the HTTP response for http and https.
+// Connecting and waiting for incoming connections is aborted when ctx is done,
+// and HTTP and HLS streams are closed with it.
+// Datagram losses of rtp remotes are reported to stats.
+func (client *Client) open(ctx context.Context, remote *remote, stats Collector) (io.ReadCloser, *http.Response, error) {
+	// HTTP requests carry the credentials of the remote
+	get := func(target *url.URL) (*http.Response, error) {
+		return client.get(ctx, target, remote)
+	}
+	url := remote.url
+	switch url.Scheme {
+	// handled by os.Open
+	case "file":
+		client.logger.Log(Dict{
+			"event": eventClientOpenPath,
+			"path": url.Path,
+			"message": fmt.Sprintf("Opening %s.", url.Path),
+		})
+		info, err := os.Stat(url.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		// regular files are played in real time, pipes and devices deliver at their own pace
+		if info.Mode().IsRegular() {
+			return client.openFile(url)
+		}
+		file, err := os.Open(url.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, nil, nil
+	case "exec":
+		// a command writing the stream to stdout
+		command := remote.command
+		if len(command) == 0 {
+			command = append([]string{url.Path}, url.Query()["arg"]...)
+		}
+		client.logger.Log(Dict{
+			"event": eventClientOpenExec,
+			"command": strings.Join(command, " "),
+			"message": fmt.Sprintf("Running %s.", strings.Join(command, " ")),
+		})
+		process, err := StartProcess(command, client.logger.Logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return process, nil, nil
+	// both handled by http.Client
+	case "http":
+		fallthrough
+	case "https":
 		client.logger.Log(Dict{
-			"event": eventClientPull,
+			"event": eventClientOpenHttp,
 			"url": url.String(),
-			"message": fmt.Sprintf("Starting to pull stream %s.", url),
+			"message": fmt.Sprintf("Connecting to %s.", url),
 		})
-		err := client.pull(url)
+		// the request can be cancelled on read timeout
+		ctx, cancel := context.WithCancel(ctx)
+		response, err := client.get(ctx, url, remote)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		err = client.check(response)
+		if err != nil {
+			response.Body.Close()
+			cancel()
+			return nil, nil, err
+		}
+		return &cancelReader{
+			ReadCloser: response.Body,
+			cancel: cancel,
+		}, response, nil
+	// HLS playlists, fetched over http or https
+	case "hls+http":
+		fallthrough
+	case "hls+https":
 		client.logger.Log(Dict{
-			"event": eventClientClosed,
+			"event": eventClientOpenHls,
 			"url": url.String(),
-			"message": fmt.Sprintf("Socket for stream %s closed", url),
+			"message": fmt.Sprintf("Loading HLS playlist %s.", url),
 		})
+		playlist := *url
+		playlist.Scheme = strings.TrimPrefix(url.Scheme, "hls+")
+		return NewHlsReader(&playlist, get, client.logger.Logger), nil, nil
+	// handled directly by net.Dialer
+	case "tcp":
+		client.logger.Log(Dict{
+			"event": eventClientOpenTcp,
+			"host": url.Host,
+			"message": fmt.Sprintf("Connecting TCP socket to %s.", url.Host),
+		})
+		conn, err := remote.dialContext(ctx, url.Scheme, url.Host)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, nil, nil
+	// passive tcp: the upstream connects to us
+	case "tcp-listen":
+		client.logger.Log(Dict{
+			"event": eventClientListenTcp,
+			"host": url.Host,
+			"message": fmt.Sprintf("Waiting for upstream connection on %s.", url.Host),
+		})
+		client.lock.Lock()
+		acceptor := client.acceptors[url.Host]
+		if acceptor == nil {
+			var err error
+			acceptor, err = NewTcpAcceptor(url.Host, client.logger.Logger)
+			if err != nil {
+				client.lock.Unlock()
+				return nil, nil, err
+			}
+			client.acceptors[url.Host] = acceptor
+		}
+		client.lock.Unlock()
+		// the connect timeout also limits how long we wait for an incoming connection
+		conn, err := acceptor.Accept(client.timeout, ctx.Done())
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, nil, nil
+	// handled by net.Dialer too, but different URL semantics
+	case "unix":
+		fallthrough
+	case "unixgram":
+		fallthrough
+	case "unixpacket":
+		client.logger.Log(Dict{
+			"event": eventClientOpenDomain,
+			"path": url.Path,
+			"message": fmt.Sprintf("Connecting domain socket to %s.", url.Path),
+		})
+		// domain sockets are local, so the binding does not apply
+		dialer := net.Dialer{
+			Timeout: client.timeout,
+		}
+		conn, err := dialer.DialContext(ctx, url.Scheme, url.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, nil, nil
+	// datagram sockets, bound locally and optionally joined to a multicast group
+	case "udp":
+		client.logger.Log(Dict{
+			"event": eventClientOpenUdp,
+			"host": url.Host,
+			"message": fmt.Sprintf("Receiving UDP datagrams on %s.", url.Host),
+		})
+		conn, err := ListenUdp(url, remote.binding)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewDatagramReader(conn), nil, nil
+	// same as udp, but with RTP encapsulation
+	case "rtp":
+		client.logger.Log(Dict{
+			"event": eventClientOpenRtp,
+			"host": url.Host,
+			"message": fmt.Sprintf("Receiving RTP datagrams on %s.", url.Host),
+		})
+		// the reordering window size can be specified with ?window=
+		window, _ := strconv.Atoi(url.Query().Get("window"))
+		conn, err := ListenUdp(url, remote.binding)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewRtpReader(conn, window, stats), nil, nil
+	default:
+		return nil, nil, ErrInvalidProtocol
+	}
+
+}
+
+// openFile opens a regular file for paced playback.
+// The bitrate for files without PCR can be set with ?bitrate=,
+// and looping can be disabled with ?loop=false.
+func (client *Client) openFile(url *url.URL) (io.ReadCloser, *http.Response, error) {
+	query := url.Query()
+	var bitrate uint64
+	if value := query.Get("bitrate"); value != "" {
+		var err error
+		bitrate, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	loop := true
+	if value := query.Get("loop"); value != "" {
+		var err error
+		loop, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	client.logger.Log(Dict{
+		"event": eventClientOpenFile,
+		"path": url.Path,
+		"bitrate": bitrate,
+		"loop": loop,
+		"message": fmt.Sprintf("Playing %s in real time.", url.Path),
+	})
+	source, err := NewFileSource(url.Path, bitrate, loop)
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, nil, nil
+}
+
+// probe watches the preferred remotes while current is streaming.
+//
+// When a remote with a better priority becomes available, it is connected
+// and read from for HoldDown. If it delivers packets without interruption
+// during that time, the connection is put on standby and the current
+// connection is closed, so the loop switches over to the preferred remote.
+//
+// Probing ends when done is closed.
+func (client *Client) probe(current *remote, done <-chan struct{}) {
+	// connecting is aborted when the current stream ends
+	ctx, cancel := stoppable(done)
+	defer cancel()
+	
+	for {
+		remote := client.preferred(current)
+		if remote == nil {
+			return
+		}
 		
-		// cleanup
-		client.Close()
-		client.input = nil
-		client.response = nil
+		// wait until the remote is off hold
+		client.lock.Lock()
+		wait := remote.next.Sub(time.Now())
+		client.lock.Unlock()
+		if wait < client.Wait {
+			wait = client.Wait
+		}
+		select {
+			case <-time.After(wait):
+			case <-done:
+				return
+		}
 		
+		client.logger.Log(Dict{
+			"event": eventClientProbe,
+			"url": remote.url.String(),
+			"address": remote.address,
+			"message": fmt.Sprintf("Probing preferred stream %s.", remote),
+		})
+		// losses on the probe do not concern the live stream
+		input, response, err := client.open(ctx, remote, &DummyCollector{})
+		if err != nil && stopped(done) {
+			// abandoned, the remote is not to blame
+			return
+		}
+		if err == nil {
+			err = client.hold(input, done)
+			if err == nil {
+				client.lock.Lock()
+				select {
+					case <-done:
+						// the current connection is gone already, the loop will pick the best remote by itself
+						client.lock.Unlock()
+						input.Close()
+						return
+					default:
+				}
+				client.standby = &connection{
+					remote: remote,
+					input: input,
+					response: response,
+				}
+				client.lock.Unlock()
+				client.Close()
+				return
+			}
+			input.Close()
+		}
+		
+		select {
+			case <-done:
+				return
+			default:
+		}
+		client.logger.Log(Dict{
+			"event": eventClientError,
+			"error": errorClientProbe,
+			"url": remote.url.String(),
+			"address": remote.address,
+			"message": err.Error(),
+		})
+		client.finish(remote, err)
+	}
+}
+
+// hold reads and discards packets from a probed connection for HoldDown.
+// Returns nil if packets were received without interruption.
+func (client *Client) hold(input io.ReadCloser, done <-chan struct{}) error {
+	// fail on a connection that stops sending
+	var reader io.Reader = input
+	if client.ReadTimeout > 0 {
+		timeout := newTimeoutReader(input, client.ReadTimeout)
+		defer timeout.Stop()
+		reader = timeout
+	}
+	// and abort when the current connection goes away
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+			case <-done:
+				input.Close()
+			case <-finished:
+		}
+	}()
+	
+	packets := NewPacketReader(reader)
+	start := time.Now()
+	for {
+		batch, err := packets.ReadBatch()
+		if err != nil {
+			return err
+		}
+		batch.Release()
+		if time.Since(start) >= client.HoldDown {
+			return nil
+		}
+	}
+}
+
+// redirect limits the number of redirects that are followed.
+// Used as CheckRedirect in the HTTP client.
+func (client *Client) redirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= client.MaxRedirects {
+		return &UpstreamError{
+			Reason: UpstreamReasonRedirect,
+			Err: ErrTooManyRedirects,
+			Detail: fmt.Sprintf("stopped after %d redirects at %s", len(via), request.URL),
+		}
+	}
+	return nil
+}
+
+// check verifies the status code and content type of an HTTP response.
+func (client *Client) check(response *http.Response) error {
+	if response.StatusCode != http.StatusOK {
+		return &UpstreamError{
+			Reason: UpstreamReasonStatus,
+			Err: ErrInvalidResponse,
+			Detail: response.Status,
+		}
+	}
+	header := response.Header.Get("Content-Type")
+	if header == "" || len(client.ContentTypes) == 0 {
+		return nil
+	}
+	mediatype, _, err := mime.ParseMediaType(header)
+	if err == nil {
+		for _, allowed := range client.ContentTypes {
+			if strings.EqualFold(mediatype, allowed) {
+				return nil
+			}
+		}
+	}
+	return &UpstreamError{
+		Reason: UpstreamReasonContentType,
+		Err: ErrInvalidContentType,
+		Detail: header,
+	}
+}
+
+// sync waits until SyncPackets packets with a sync byte at a fixed stride
+// are buffered, and skips everything before the first one.
+func (client *Client) sync(reader *bufio.Reader) error {
+	count := client.SyncPackets
+	if count < 1 {
+		return nil
+	}
+	if (count + 1) * RsPacketSize > reader.Size() {
+		count = reader.Size() / RsPacketSize - 1
+	}
+	// look at one more packet, so we can start anywhere in the first one
+	data, err := reader.Peek((count + 1) * RsPacketSize)
+	if err != nil && len(data) < count * PacketSize {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = &UpstreamError{
+				Reason: UpstreamReasonSync,
+				Err: ErrNoSync,
+				Detail: fmt.Sprintf("stream ended after %d bytes", len(data)),
+			}
+		}
 		return err
 	}
-	return ErrAlreadyConnected
+	offset, stride := findSync(data, count)
+	if stride != 0 && offset < stride {
+		reader.Discard(offset)
+		return nil
+	}
+	return &UpstreamError{
+		Reason: UpstreamReasonSync,
+		Err: ErrNoSync,
+		Detail: fmt.Sprintf("no %d consecutive packets found", count),
+	}
+}
+
+// get sends an HTTP GET request for an upstream resource,
+// with the headers and credentials of remote and through its binding.
+func (client *Client) get(ctx context.Context, url *url.URL, remote *remote) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	err = remote.credentials.Apply(request)
+	if err != nil {
+		return nil, err
+	}
+	return remote.getter.Do(request)
 }
 
 // pull streams data from the socket into the queue.
-func (client *Client) pull(url *url.URL) error {
+func (client *Client) pull(remote *remote) error {
+	url := remote.url
 	// declare here so we can send back individual errors
 	var err error
-	// the packet queue will be allocated and connected to the streamer as soon as the first packet has been received
-	var queue chan Packet
+	// set as soon as the first packet has been received
+	connected := false
+	// set when the stream has been verified to contain TS packets
+	synced := false
 	// save a few bytes
-	var packet Packet
+	var batch *Batch
+	// reads fail with ErrReadTimeout when the upstream stops sending
+	var input io.Reader = client.input
+	if client.ReadTimeout > 0 {
+		timeout := newTimeoutReader(client.input, client.ReadTimeout)
+		defer timeout.Stop()
+		input = timeout
+	}
+	// buffered, so we can look ahead for sync bytes
+	reader := bufio.NewReaderSize(input, clientSyncBufferSize)
+	// splits the stream into packets
+	packets := NewPacketReader(reader)
+	packets.SetCollector(client.stats)
 	
 	for LoadBool(&client.running) {
-		// somewhat hacky read timeout:
-		// close the connection when the timer fires.
-		var timer *time.Timer
-		if client.ReadTimeout > 0 {
-			timer = time.AfterFunc(client.ReadTimeout, func() {
+		// read some packets
+		//log.Printf("Reading packets from %p\n", client.input)
+		if !synced {
+			err = client.sync(reader)
+			synced = err == nil
+		}
+		if err == nil {
+			batch, err = packets.ReadBatch()
+		}
+		//log.Printf("Packet read complete, batch=%p, err=%p\n", batch, err)
+		if err != nil {
+			if err == ErrReadTimeout {
 				client.logger.Log(Dict{
 					"event": eventClientReadTimeout,
-					"message": "Read timeout exceeded, closing connection",
+					"url": url.String(),
+					"address": remote.address,
+					"timeout": client.ReadTimeout.Seconds(),
+					"message": fmt.Sprintf("No data received from %s for %0.0f seconds", remote, client.ReadTimeout.Seconds()),
 				})
-				client.input.Close()
-			})
-		}
-		// read a packet
-		//log.Printf("Reading a packet from %p\n", client.input)
-		packet, err = ReadPacket(client.input)
-		// we got a packet, stop the timer and drain it
-		if timer != nil && !timer.Stop() {
-			client.logger.Log(Dict{
-				"event": eventClientTimerStop,
-				"url": url.String(),
-				"message": fmt.Sprintf("Stopping timer on %s", url),
-			})
-			select {
-				case <-timer.C:
-				default:
 			}
-			client.logger.Log(Dict{
-				"event": eventClientTimerStopped,
-				"url": url.String(),
-				"message": fmt.Sprintf("Stopped timer on %s", url),
-			})
-		}
-		//log.Printf("Packet read complete, packet=%p, err=%p\n", packet, err)
-		if err != nil {
 			StoreBool(&client.running, false)
 		} else {
-			if packet != nil {
-				// report connection up
-				if queue == nil {
-					client.listener.Connect()
-					client.stats.SourceConnected()
-					client.logger.Log(Dict{
-						"event": eventClientStarted,
-						"url": url.String(),
-					})
-					queue = make(chan Packet, client.queueSize)
-					go client.streamer.Stream(queue)
-				}
-				
-				// report the packet
-				client.stats.PacketReceived()
-				
-				//log.Printf("Got a packet (length %d):\n%s\n", len(packet), hex.Dump(packet))
-				//log.Printf("Got a packet (length %d)\n", len(packet))
-				queue<- packet
-			} else {
+			// report connection up
+			if !connected {
+				connected = true
+				client.lock.Lock()
+				remote.connected = true
+				remote.lastConnect = time.Now()
+				client.lock.Unlock()
+				client.listener.Connect()
+				client.stats.SourceConnected()
 				client.logger.Log(Dict{
-					"event": eventClientNoPacket,
+					"event": eventClientStarted,
 					"url": url.String(),
-					"message": "No packet received",
+					"address": remote.address,
+					"packetsize": packets.Stride(),
 				})
 			}
+			
+			// report the packets
+			client.stats.PacketsReceived(batch.Len())
+			
+			//log.Printf("Got a batch (length %d)\n", batch.Len())
+			client.queue<- batch
 		}
 	}
 	
 	// and the connection is gone
-	if queue != nil {
-		client.logger.Log(Dict{
-			"event": eventClientTimerKill,
-			"url": url.String(),
-			"message": fmt.Sprintf("Killing queue on %s", url),
-		})
-		close(queue)
+	if connected {
+		client.listener.Close()
 		client.stats.SourceDisconnected()
 		client.logger.Log(Dict{
 			"event": eventClientStopped,
 			"url": url.String(),
+			"address": remote.address,
 		})
 	}
 	
@@ -21,6 +21,42 @@ import (
 	"encoding/json"
 )
 
+// RemoteConfig is an upstream URL with its failover settings.
+// In the configuration file, it can be given as an object or as a plain URL string.
+type RemoteConfig struct {
+	// Url is the upstream URL
+	Url string `json:"url"`
+	// Priority is the failover tier, lower values are preferred.
+	// 0 is the primary tier.
+	Priority uint `json:"priority"`
+	// Weight is the relative share of connections among remotes
+	// of the same priority. 0 is the same as 1.
+	Weight uint `json:"weight"`
+	// Credentials are HTTP headers and authentication for this remote.
+	// Unset values are inherited from the resource.
+	Credentials
+	// Command is the command line of an exec remote, executable first.
+	// If it is empty, the command of the resource is used.
+	Command []string `json:"command"`
+	// Binding is the local address and interface for outgoing connections.
+	// Unset values are inherited from the resource.
+	Binding
+}
+
+// UnmarshalJSON decodes a remote from an object or a URL string.
+func (remote *RemoteConfig) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*remote = RemoteConfig{
+			Url: url,
+		}
+		return nil
+	}
+	// avoid recursing into this method
+	type plain RemoteConfig
+	return json.Unmarshal(data, (*plain)(remote))
+}
+
 // Configuration is a representation of the configurable settings.
 // These are normally read from a JSON file and deserialized by
 // the builtin marshaler.
@@ -32,8 +68,40 @@ type Configuration struct {
 	Timeout uint `json:"timeout"`
 	// Reconnect is the reconnect delay
 	Reconnect uint `json:"reconnect"`
+	// ReconnectMax is the maximum reconnect delay for
+	// remotes that fail repeatedly
+	ReconnectMax uint `json:"reconnectmax"`
+	// Jitter is the random variation of reconnect delays,
+	// as a fraction of the delay
+	Jitter float64 `json:"jitter"`
+	// HoldDown is the time a preferred remote must stream without
+	// interruption before a stream switches back to it from a backup
+	HoldDown uint `json:"holddown"`
+	// Grace is the time that clients stay connected
+	// while a stream is waiting for its upstream to come back
+	Grace uint `json:"grace"`
 	// ReadTimeout is the upstream read timeout
 	ReadTimeout uint `json:"readtimeout"`
+	// MaxRedirects is the number of HTTP redirects that are followed
+	MaxRedirects int `json:"maxredirects"`
+	// ContentTypes is the list of acceptable upstream content types.
+	// An empty list accepts everything.
+	ContentTypes []string `json:"contenttypes"`
+	// SyncPackets is the number of consecutive TS packets that must
+	// be received before an upstream is considered connected
+	SyncPackets int `json:"syncpackets"`
+	// PidTimeout is the time after which an elementary stream that
+	// is announced in a PMT, but not received, is reported as missing
+	PidTimeout uint `json:"pidtimeout"`
+	// Linger is the time that on-demand streams stay connected
+	// after the last viewer has left
+	Linger uint `json:"linger"`
+	// DemandTimeout is the time that the first viewer of an on-demand
+	// stream waits for the upstream to come online
+	DemandTimeout uint `json:"demandtimeout"`
+	// ResolveInterval is the time after which the host names
+	// of resolved remotes are looked up again
+	ResolveInterval uint `json:"resolveinterval"`
 	// InputBuffer is the maximum number of packets
 	// on the input buffer
 	InputBuffer uint `json:"inputbuffer"`
@@ -63,12 +131,33 @@ type Configuration struct {
 		// Serve is the local URL to serve this stream under
 		Serve string `json:"serve"`
 		// Remote is a single upstream URL or API argument
-		// will be added to Remotes during parsing
+		// will be added to Remotes during parsing, with priority 0
 		Remote string `json:"remote"`
 		// Remotes is the upstream URLs
-		Remotes []string `json:"remotes"`
+		Remotes []RemoteConfig `json:"remotes"`
+		// Program is the program number that is extracted (program only)
+		Program uint16 `json:"program"`
 		// Cache the cache time in seconds
 		Cache uint `json:"cache"`
+		// Key is the stream key that publishers must supply (ingest only)
+		Key string `json:"key"`
+		// Fallback is a TS file that is played while the upstream is offline
+		Fallback string `json:"fallback"`
+		// Profiles are named selections of components that clients can request
+		Profiles map[string]OutputProfile `json:"profiles"`
+		// OnDemand connects the upstream only while there are viewers
+		OnDemand bool `json:"ondemand"`
+		// Resolve treats each address of a remote host name as a separate remote
+		Resolve bool `json:"resolve"`
+		// Command is the command line for exec remotes without their own
+		Command []string `json:"command"`
+		// Binding is the local address and interface for outgoing connections
+		// and multicast joins, for all remotes
+		Binding
+		// Credentials are HTTP headers and authentication for all remotes
+		Credentials
+		// Tls contains the TLS settings for https remotes
+		Tls TlsConfig `json:"tls"`
 	} `json:"resources"`
 }
 
@@ -79,6 +168,16 @@ func DefaultConfiguration() Configuration {
 		Listen: "localhost:http",
 		Timeout: 0,
 		Reconnect: 10,
+		ReconnectMax: 300,
+		Jitter: 0.2,
+		HoldDown: 30,
+		Grace: 10,
+		MaxRedirects: 5,
+		SyncPackets: 5,
+		PidTimeout: 5,
+		Linger: 60,
+		DemandTimeout: 10,
+		ResolveInterval: 300,
 		InputBuffer: 1000,
 		OutputBuffer: 400,
 		MaxConnections: 1,
@@ -101,11 +200,22 @@ func LoadConfiguration(filename string) (Configuration, error) {
 		// add remote to remotes list, if given
 		if len(config.Resources[i].Remote) > 0 {
 			length := len(config.Resources[i].Remotes)
-			remotes := make([]string, length + 1)
-			remotes[0] = config.Resources[i].Remote
+			remotes := make([]RemoteConfig, length + 1)
+			remotes[0] = RemoteConfig{
+				Url: config.Resources[i].Remote,
+			}
 			copy(remotes[1:], config.Resources[i].Remotes)
 			config.Resources[i].Remotes = remotes
 		}
+		// pass resource credentials, commands and bindings on to the remotes
+		for j := range config.Resources[i].Remotes {
+			remote := &config.Resources[i].Remotes[j]
+			remote.Credentials = remote.Credentials.Inherit(config.Resources[i].Credentials)
+			remote.Binding = remote.Binding.Inherit(config.Resources[i].Binding)
+			if len(remote.Command) == 0 {
+				remote.Command = config.Resources[i].Command
+			}
+		}
 	}
 	
 	return config, err
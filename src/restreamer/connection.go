@@ -30,6 +30,7 @@ const (
 	eventConnectionClosed = "closed"
 	eventConnectionClosedWait = "closedwait"
 	eventConnectionShutdown = "shutdown"
+	eventConnectionOffline = "offline"
 	eventConnectionDone = "done"
 	//
 	errorConnectionNotFlushable = "noflush"
@@ -41,17 +42,23 @@ const (
 // This is meant to be called directly from a ServeHTTP handler.
 // No separate thread is created.
 type Connection struct {
-	// Queue is the per-connection packet queue
-	Queue chan Packet
+	// Queue is the per-connection packet queue.
+	// Each batch holds a reference that is released after sending.
+	Queue chan *Batch
+	// shutdown is signalled when the connection should be dropped
+	shutdown chan bool
 	// the destination socket
 	writer http.ResponseWriter
 	// needed for flushing
 	flusher http.Flusher
 	// logger is a json logger
 	logger *ModuleLogger
+	// filter selects the components that are sent, nil sends everything
+	filter *outputFilter
 }
 
 // NewConnection creates a new connection object.
+// qsize is the queue length, in batches.
 // To start sending data to a client, call Serve().
 func NewConnection(destination http.ResponseWriter, qsize int) (*Connection) {
 	logger := &ModuleLogger{
@@ -70,7 +77,9 @@ func NewConnection(destination http.ResponseWriter, qsize int) (*Connection) {
 		})
 	}
 	conn := &Connection{
-		Queue: make(chan Packet, qsize),
+		Queue: make(chan *Batch, qsize),
+		// buffered, so the notifier never blocks
+		shutdown: make(chan bool, 1),
 		writer: destination,
 		flusher: flusher,
 		logger: logger,
@@ -116,12 +125,13 @@ func (conn *Connection) Serve() {
 	running := true
 	for running {
 		select {
-			case packet, ok := <-conn.Queue:
+			case batch, ok := <-conn.Queue:
 				if ok {
-					// packet received, log
-					//log.Printf("Sending packet (length %d):\n%s\n", len(packet), hex.Dump(packet))
-					// send the packet out
-					_, err := conn.writer.Write(packet)
+					// packets received, log
+					//log.Printf("Sending batch (length %d)\n", batch.Len())
+					// send the packets out, all at once
+					_, err := conn.writer.Write(batch.Bytes())
+					batch.Release()
 					if err == nil {
 						if conn.flusher != nil {
 							conn.flusher.Flush()
@@ -142,6 +152,13 @@ func (conn *Connection) Serve() {
 					})
 					running = false
 				}
+			case <-conn.shutdown:
+				// the upstream is gone for good
+				conn.logger.Log(Dict{
+					"event": eventConnectionOffline,
+					"message": "Stream went offline, closing client connection",
+				})
+				running = false
 			case <-notifier.CloseNotify():
 				// connection closed while we were waiting for more data
 				conn.logger.Log(Dict{
@@ -0,0 +1,109 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"strings"
+	"net/http"
+	"io/ioutil"
+)
+
+// Credentials are custom headers and authentication data that are sent
+// with upstream HTTP requests.
+//
+// Secrets can be given inline or read from a file. Files are read on each
+// request, so they can be replaced without restarting.
+type Credentials struct {
+	// Headers are additional request headers, such as User-Agent or Referer.
+	// A Host header replaces the host name sent to the server.
+	Headers map[string]string `json:"headers"`
+	// User is the user name for basic authentication
+	User string `json:"user"`
+	// Password is the password for basic authentication
+	Password string `json:"password"`
+	// PasswordFile is a file containing the password, used if Password is empty
+	PasswordFile string `json:"passwordfile"`
+	// Token is sent as a bearer token in the Authorization header.
+	// It takes precedence over basic authentication.
+	Token string `json:"token"`
+	// TokenFile is a file containing the token, used if Token is empty
+	TokenFile string `json:"tokenfile"`
+}
+
+// Inherit returns a copy of the credentials where unset values are taken from defaults.
+// Headers are merged, with the ones that are already set taking precedence.
+func (credentials Credentials) Inherit(defaults Credentials) Credentials {
+	if len(defaults.Headers) > 0 {
+		headers := make(map[string]string, len(defaults.Headers) + len(credentials.Headers))
+		for key, value := range defaults.Headers {
+			headers[key] = value
+		}
+		for key, value := range credentials.Headers {
+			headers[key] = value
+		}
+		credentials.Headers = headers
+	}
+	if credentials.User == "" {
+		credentials.User = defaults.User
+		credentials.Password = defaults.Password
+		credentials.PasswordFile = defaults.PasswordFile
+	}
+	if credentials.Token == "" && credentials.TokenFile == "" {
+		credentials.Token = defaults.Token
+		credentials.TokenFile = defaults.TokenFile
+	}
+	return credentials
+}
+
+// Apply adds the headers and authentication data to a request.
+func (credentials *Credentials) Apply(request *http.Request) error {
+	for key, value := range credentials.Headers {
+		if http.CanonicalHeaderKey(key) == "Host" {
+			request.Host = value
+		} else {
+			request.Header.Set(key, value)
+		}
+	}
+	if credentials.User != "" {
+		password, err := readSecret(credentials.Password, credentials.PasswordFile)
+		if err != nil {
+			return err
+		}
+		request.SetBasicAuth(credentials.User, password)
+	}
+	token, err := readSecret(credentials.Token, credentials.TokenFile)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer " + token)
+	}
+	return nil
+}
+
+// readSecret returns value if it is set, or the contents of file otherwise.
+// Surrounding whitespace, like a trailing newline, is removed from the file contents.
+func readSecret(value string, file string) (string, error) {
+	if value != "" || file == "" {
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,186 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"bufio"
+	"errors"
+	"strings"
+	"syscall"
+	"os/exec"
+)
+
+const (
+	moduleProcess = "process"
+	//
+	eventProcessStarted = "started"
+	eventProcessOutput = "output"
+	eventProcessExited = "exited"
+	eventProcessKill = "kill"
+	//
+	// processKillTimeout is the time a command gets to shut down after SIGTERM,
+	// before it is killed
+	processKillTimeout = 5 * time.Second
+	// processMaxLine is the maximum length of a logged stderr line
+	processMaxLine = 64 * 1024
+)
+
+var (
+	// ErrNoCommand is thrown when an exec remote has no command.
+	ErrNoCommand = errors.New("restreamer: no command configured")
+	// ErrProcessClosed is thrown when closing a process twice.
+	ErrProcessClosed = errors.New("restreamer: process already closed")
+)
+
+// Process is a command that delivers a stream on its standard output.
+//
+// The command runs in its own process group, so shell pipelines are
+// terminated as a whole when the process is closed.
+// Each line the command writes to standard error is logged.
+type Process struct {
+	// cmd is the running command
+	cmd *exec.Cmd
+	// stdout is the read end of the standard output pipe
+	stdout *os.File
+	// exited is closed when the command has terminated
+	exited chan struct{}
+	// closed is set when Close() was called
+	closed AtomicBool
+	// logger is a json logger
+	logger *ModuleLogger
+}
+
+// StartProcess starts a command. The first element of command is the
+// executable, the others are its arguments.
+func StartProcess(command []string, logger JsonLogger) (*Process, error) {
+	if len(command) == 0 || command[0] == "" {
+		return nil, ErrNoCommand
+	}
+	
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		stdoutWriter.Close()
+		return nil, err
+	}
+	
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	err = cmd.Start()
+	// the child has its own copies now
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return nil, err
+	}
+	
+	process := &Process{
+		cmd: cmd,
+		stdout: stdout,
+		exited: make(chan struct{}),
+		closed: AtomicFalse,
+		logger: &ModuleLogger{
+			Logger: logger,
+			Defaults: Dict{
+				"module": moduleProcess,
+				"command": strings.Join(command, " "),
+				"pid": cmd.Process.Pid,
+			},
+			AddTimestamp: true,
+		},
+	}
+	process.logger.Log(Dict{
+		"event": eventProcessStarted,
+		"message": fmt.Sprintf("Started %s with pid %d", command[0], cmd.Process.Pid),
+	})
+	go process.log(stderr)
+	go process.reap()
+	return process, nil
+}
+
+// log forwards the standard error output of the command to the logger, line by line.
+func (process *Process) log(stderr *os.File) {
+	defer stderr.Close()
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 4096), processMaxLine)
+	for scanner.Scan() {
+		process.logger.Log(Dict{
+			"event": eventProcessOutput,
+			"message": scanner.Text(),
+		})
+	}
+}
+
+// reap waits for the command to terminate and logs the exit status.
+func (process *Process) reap() {
+	err := process.cmd.Wait()
+	status := "exit status 0"
+	if err != nil {
+		status = err.Error()
+	}
+	process.logger.Log(Dict{
+		"event": eventProcessExited,
+		"status": status,
+		"message": fmt.Sprintf("Command terminated: %s", status),
+	})
+	close(process.exited)
+}
+
+// Read reads from the standard output of the command.
+func (process *Process) Read(data []byte) (int, error) {
+	return process.stdout.Read(data)
+}
+
+// SetReadDeadline sets a deadline for reading the standard output.
+func (process *Process) SetReadDeadline(deadline time.Time) error {
+	return process.stdout.SetReadDeadline(deadline)
+}
+
+// Close terminates the command and waits until it has exited.
+// The command is killed if it does not exit within a few seconds.
+func (process *Process) Close() error {
+	if !CompareAndSwapBool(&process.closed, false, true) {
+		return ErrProcessClosed
+	}
+	// signal the whole process group
+	group := -process.cmd.Process.Pid
+	syscall.Kill(group, syscall.SIGTERM)
+	select {
+		case <-process.exited:
+		case <-time.After(processKillTimeout):
+			process.logger.Log(Dict{
+				"event": eventProcessKill,
+				"message": fmt.Sprintf("Command did not terminate within %0.0f seconds, killing it", processKillTimeout.Seconds()),
+			})
+			syscall.Kill(group, syscall.SIGKILL)
+			<-process.exited
+	}
+	return process.stdout.Close()
+}
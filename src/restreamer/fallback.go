@@ -0,0 +1,156 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"io"
+	"os"
+	"errors"
+)
+
+var (
+	// ErrEmptyFallback is thrown when a fallback file contains no TS packets.
+	ErrEmptyFallback = errors.New("restreamer: fallback file contains no packets")
+)
+
+// Fallback is a TS file that is played in a loop while a stream is offline.
+//
+// The file is streamed from disk each time it is played, paced by its PCRs
+// like a file remote. Continuity counters are kept consistent and
+// discontinuities are signalled when it starts over.
+type Fallback struct {
+	// path is the file name
+	path string
+}
+
+// LoadFallback checks that a fallback TS file can be read and contains packets.
+// M2TS and 204 byte packet files are converted to plain TS.
+func LoadFallback(path string) (*Fallback, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	
+	batch, err := NewPacketReader(file).ReadBatch()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrEmptyFallback
+	}
+	if err != nil {
+		return nil, err
+	}
+	batch.Release()
+	
+	return &Fallback{
+		path: path,
+	}, nil
+}
+
+// play sends the fallback packets to output, in a loop, until stop is closed.
+// Packets are sent in batches, as soon as they are due.
+// Returns nil when stopped, or the error that ended playback.
+func (fallback *Fallback) play(output chan<- *Batch, stop <-chan struct{}) error {
+	source, err := NewFileSource(fallback.path, 0, true)
+	if err != nil {
+		return err
+	}
+	// closing the source also aborts waiting for the next packet
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+			case <-stop:
+			case <-done:
+		}
+		source.Close()
+	}()
+	
+	reader := NewPacketReader(source)
+	for {
+		batch, err := reader.ReadBatch()
+		if err != nil {
+			if stopped(stop) {
+				return nil
+			}
+			return err
+		}
+		select {
+			case output<- batch:
+			case <-stop:
+				batch.Release()
+				return nil
+		}
+	}
+}
+
+// splicer keeps continuity counters consistent when the source of a stream changes.
+//
+// After a splice, the continuity counter of each PID is corrected so it continues
+// from the last packet that was sent, and the discontinuity indicator is set in the
+// first packet with an adaptation field, so decoders resynchronise their clocks.
+type splicer struct {
+	// generation is incremented on each splice
+	generation uint32
+	// seen contains the generation in which each PID was last seen, or 0 if never
+	seen [PidCount]uint32
+	// offset is the continuity counter correction of each PID
+	offset [PidCount]uint8
+	// last is the last continuity counter that was sent on each PID
+	last [PidCount]uint8
+	// pending is true for PIDs that still need a discontinuity indicator
+	pending [PidCount]bool
+}
+
+// newSplicer creates a splicer that passes packets through unchanged until the first splice.
+func newSplicer() *splicer {
+	return &splicer{
+		generation: 1,
+	}
+}
+
+// splice marks a source change. The next packets are adjusted.
+func (splicer *splicer) splice() {
+	splicer.generation++
+}
+
+// process corrects the continuity counter of a packet and sets the
+// discontinuity indicator if needed. The packet is modified in place.
+func (splicer *splicer) process(packet Packet) {
+	pid := packet.Pid()
+	if pid == NullPid {
+		return
+	}
+	counter := packet.ContinuityCounter()
+	if splicer.seen[pid] != splicer.generation {
+		if splicer.seen[pid] != 0 {
+			// continue where the last source left off
+			next := splicer.last[pid]
+			if packet.HasPayload() {
+				next++
+			}
+			splicer.offset[pid] = (next - counter) & 0x0f
+			splicer.pending[pid] = true
+		}
+		splicer.seen[pid] = splicer.generation
+	}
+	counter = (counter + splicer.offset[pid]) & 0x0f
+	packet.SetContinuityCounter(counter)
+	splicer.last[pid] = counter
+	if splicer.pending[pid] && packet.SetDiscontinuity() {
+		splicer.pending[pid] = false
+	}
+}
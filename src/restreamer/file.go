@@ -0,0 +1,177 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"io"
+	"os"
+	"time"
+	"errors"
+)
+
+var (
+	// ErrEmptyFile is thrown when a looping file source contains no TS packets.
+	ErrEmptyFile = errors.New("restreamer: file contains no packets")
+	// ErrFileClosed is thrown when reading from a closed file source.
+	ErrFileClosed = errors.New("restreamer: file source closed")
+)
+
+// FileSource plays a TS file in real time.
+//
+// Playback is paced by the PCRs on the first PID that carries them.
+// Until the first PCR is found, or if there is none, the configured bitrate is used.
+// At the end of the file, playback starts over if looping is enabled.
+// Continuity counters are kept consistent and discontinuities are signalled
+// when the file starts over, as for the fallback.
+//
+// The output is a stream of 188 byte TS packets, that can be consumed by
+// a PacketReader.
+type FileSource struct {
+	// file is the input file
+	file *os.File
+	// reader splits the file into packets
+	reader *PacketReader
+	// loop is true if playback starts over at the end of the file
+	loop bool
+	// pacer keeps track of the playing time
+	pacer *pacer
+	// splicer keeps the output consistent when the file starts over
+	splicer *splicer
+	// batch is the batch that is currently being played, may be nil
+	batch *Batch
+	// index is the next packet in batch
+	index int
+	// played is the number of packets played since the file was last started over
+	played int
+	// pending is the next packet, waiting until it is due
+	pending Packet
+	// rest is the unsent part of the current packet
+	rest []byte
+	// closed is closed when the source is closed, to abort waiting
+	closed chan struct{}
+}
+
+// NewFileSource opens a TS file for paced playback.
+// bitrate is the playback rate for files without PCR, in bits per second,
+// 0 selects PacerDefaultBitrate. If loop is true, playback starts over at the end of the file.
+func NewFileSource(path string, bitrate uint64, loop bool) (*FileSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSource{
+		file: file,
+		reader: NewPacketReader(file),
+		loop: loop,
+		pacer: newPacer(bitrate),
+		splicer: newSplicer(),
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// Close stops playback and closes the file.
+func (source *FileSource) Close() error {
+	select {
+		case <-source.closed:
+			return ErrFileClosed
+		default:
+			close(source.closed)
+	}
+	return source.file.Close()
+}
+
+// Read returns the next packets, waiting until they are due.
+func (source *FileSource) Read(data []byte) (int, error) {
+	count := 0
+	for count < len(data) {
+		if len(source.rest) > 0 {
+			copied := copy(data[count:], source.rest)
+			source.rest = source.rest[copied:]
+			count += copied
+			continue
+		}
+		if source.pending == nil {
+			packet, err := source.next()
+			if err != nil {
+				if count > 0 {
+					return count, nil
+				}
+				return 0, err
+			}
+			source.pending = packet
+		}
+		if wait := source.pacer.due(); wait > 0 {
+			// return what we have before waiting
+			if count > 0 {
+				return count, nil
+			}
+			timer := time.NewTimer(wait)
+			select {
+				case <-timer.C:
+				case <-source.closed:
+					timer.Stop()
+					return 0, ErrFileClosed
+			}
+		}
+		source.rest = source.pending
+		source.pending = nil
+	}
+	return count, nil
+}
+
+// next returns the next packet, starting over at the end of the file.
+// The packet is corrected by the splicer and the stream clock is
+// advanced to its playing time.
+func (source *FileSource) next() (Packet, error) {
+	for source.batch == nil || source.index >= source.batch.Len() {
+		if source.batch != nil {
+			source.batch.Release()
+			source.batch = nil
+		}
+		select {
+			case <-source.closed:
+				return nil, ErrFileClosed
+			default:
+		}
+		batch, err := source.reader.ReadBatch()
+		if (err == io.EOF || err == io.ErrUnexpectedEOF) && source.loop {
+			if source.played == 0 {
+				return nil, ErrEmptyFile
+			}
+			// start over
+			_, err = source.file.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+			source.reader = NewPacketReader(source.file)
+			source.splicer.splice()
+			source.played = 0
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		source.batch = batch
+		source.index = 0
+	}
+	packet := source.batch.Packets[source.index]
+	source.index++
+	source.played++
+	source.splicer.process(packet)
+	source.pacer.schedule(packet)
+	return packet, nil
+}
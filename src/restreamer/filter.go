@@ -0,0 +1,398 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"strconv"
+	"errors"
+	"net/url"
+)
+
+var (
+	// ErrInvalidPid is returned when a PID list can not be parsed
+	ErrInvalidPid = errors.New("restreamer: invalid PID")
+	// ErrInvalidProgram is returned when a program list can not be parsed
+	ErrInvalidProgram = errors.New("restreamer: invalid program number")
+)
+
+// OutputProfile selects the programs and components of a stream that a connection receives.
+//
+// An elementary stream is sent if it matches all criteria that are set.
+// PAT and PMTs are rewritten, so they only announce the programs and streams
+// that are left. PIDs that are not announced in any PMT are only sent if
+// they are listed in Pids.
+type OutputProfile struct {
+	// Programs is the list of program numbers to send
+	Programs []uint16 `json:"programs"`
+	// Pids is the list of PIDs to send
+	Pids []uint16 `json:"pids"`
+	// Kinds is the list of stream kinds to send: video, audio, subtitles or data
+	Kinds []string `json:"kinds"`
+	// Languages is the list of ISO 639 language codes to send.
+	// Streams without a language are not affected.
+	Languages []string `json:"languages"`
+}
+
+// Empty returns true if the profile does not restrict anything.
+func (profile OutputProfile) Empty() bool {
+	return len(profile.Programs) == 0 && len(profile.Pids) == 0 && len(profile.Kinds) == 0 && len(profile.Languages) == 0
+}
+
+// key returns a canonical representation of the profile,
+// so connections with the same selection can share a filter.
+func (profile OutputProfile) key() string {
+	return fmt.Sprintf("%s/%s/%s/%s", canonical(numbers(profile.Programs)), canonical(numbers(profile.Pids)), canonical(profile.Kinds), canonical(profile.Languages))
+}
+
+// numbers converts a list of numbers to strings.
+func numbers(list []uint16) []string {
+	strs := make([]string, len(list))
+	for i, number := range list {
+		strs[i] = strconv.Itoa(int(number))
+	}
+	return strs
+}
+
+// canonical sorts a copy of a list and joins it.
+func canonical(list []string) string {
+	sorted := make([]string, len(list))
+	for i, item := range list {
+		sorted[i] = strings.ToLower(item)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// selects returns true if a program is selected by the profile.
+func (profile OutputProfile) selects(program ProgramInfo) bool {
+	if len(profile.Programs) == 0 {
+		return true
+	}
+	for _, number := range profile.Programs {
+		if number == program.Number {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if an elementary stream is selected by the profile.
+func (profile OutputProfile) matches(stream ElementaryStream) bool {
+	if len(profile.Pids) > 0 {
+		found := false
+		for _, pid := range profile.Pids {
+			found = found || pid == stream.Pid
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(profile.Kinds) > 0 {
+		found := false
+		for _, kind := range profile.Kinds {
+			found = found || strings.EqualFold(kind, stream.Kind)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(profile.Languages) > 0 && stream.Language != "" {
+		found := false
+		for _, language := range profile.Languages {
+			found = found || strings.EqualFold(language, stream.Language)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseOutputProfile creates a profile from the query parameters programs, pids, kinds and languages.
+// Each parameter can be repeated or contain a comma-separated list.
+func ParseOutputProfile(query url.Values) (OutputProfile, error) {
+	var profile OutputProfile
+	for _, number := range splitQuery(query["programs"]) {
+		value, err := strconv.ParseUint(number, 0, 16)
+		if err != nil || value == 0 {
+			return OutputProfile{}, ErrInvalidProgram
+		}
+		profile.Programs = append(profile.Programs, uint16(value))
+	}
+	for _, pid := range splitQuery(query["pids"]) {
+		value, err := strconv.ParseUint(pid, 0, 16)
+		if err != nil || value >= PidCount {
+			return OutputProfile{}, ErrInvalidPid
+		}
+		profile.Pids = append(profile.Pids, uint16(value))
+	}
+	profile.Kinds = splitQuery(query["kinds"])
+	profile.Languages = splitQuery(query["languages"])
+	return profile, nil
+}
+
+// splitQuery splits comma-separated query values and drops empty ones.
+func splitQuery(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// outputFilter removes the streams that a profile does not select from the
+// batches of a streamer, and rewrites the PAT and PMTs to match.
+//
+// Connections with the same profile share a filter, so each batch is only
+// filtered once. Apart from users, which is protected by the streamer lock,
+// the filter is only accessed from the streaming thread.
+type outputFilter struct {
+	// profile is the selection
+	profile OutputProfile
+	// key identifies the filter among the filters of the streamer
+	key string
+	// users is the number of connections using this filter
+	users int
+	// generation is the PSI generation the filter was built for
+	generation uint
+	// keep contains true for each PID that is passed through unchanged
+	keep [PidCount]bool
+	// pcr contains true for each PID that is only needed for its PCRs.
+	// Its packets are reduced to an adaptation field with the PCR.
+	pcr [PidCount]bool
+	// tables contains the rewritten PSI of each PSI PID, as packet payload
+	// that starts with a pointer field. It is sent in place of the original
+	// each time a section starts on that PID.
+	tables map[uint16][]byte
+	// counters are the continuity counters of the rewritten PSI
+	counters map[uint16]uint8
+	// programs are the PAT entries of the last rewritten PAT
+	programs []byte
+	// version is the version of the rewritten PAT
+	version int
+	// scratch is used to assemble packets
+	scratch [PacketSize]byte
+}
+
+// newOutputFilter creates a filter for a profile.
+func newOutputFilter(profile OutputProfile) *outputFilter {
+	return &outputFilter{
+		profile: profile,
+		key: profile.key(),
+		tables: make(map[uint16][]byte),
+		counters: make(map[uint16]uint8),
+		version: -1,
+	}
+}
+
+// rebuild updates the filter from the current program tables.
+func (filter *outputFilter) rebuild(psi *psi) {
+	filter.generation = psi.generation
+	filter.keep = [PidCount]bool{}
+	filter.pcr = [PidCount]bool{}
+	filter.tables = make(map[uint16][]byte)
+	if psi.table.Version < 0 {
+		// nothing is known yet
+		return
+	}
+	
+	announced := [PidCount]bool{}
+	announced[PatPid] = true
+	var entries []byte
+	pmts := make(map[uint16][]byte)
+	for _, program := range psi.table.Programs {
+		announced[program.PmtPid] = true
+		for _, stream := range program.Streams {
+			announced[stream.Pid] = true
+		}
+		section := psi.pmtSection(program)
+		if section == nil || !filter.profile.selects(program) {
+			// not selected, or waiting for the PMT
+			continue
+		}
+		selected := [PidCount]bool{}
+		found := false
+		for _, stream := range program.Streams {
+			if filter.profile.matches(stream) {
+				selected[stream.Pid] = true
+				found = true
+			}
+		}
+		pmt := filterPmt(section, &selected)
+		if !found || pmt == nil {
+			continue
+		}
+		for pid := range selected {
+			filter.keep[pid] = filter.keep[pid] || selected[pid]
+		}
+		if program.PcrPid != NullPid && !selected[program.PcrPid] {
+			// a dedicated PCR PID is sent as it is, a removed stream only with its PCRs
+			dedicated := true
+			for _, stream := range program.Streams {
+				dedicated = dedicated && stream.Pid != program.PcrPid
+			}
+			if dedicated {
+				filter.keep[program.PcrPid] = true
+			} else {
+				filter.pcr[program.PcrPid] = true
+			}
+		}
+		pmts[program.PmtPid] = append(pmts[program.PmtPid], pmt...)
+		entries = append(entries, byte(program.Number >> 8), byte(program.Number), 0xe0 | byte(program.PmtPid >> 8), byte(program.PmtPid))
+	}
+	// PIDs that no program announces are only sent on request
+	for _, pid := range filter.profile.Pids {
+		if !announced[pid] {
+			filter.keep[pid] = true
+		}
+	}
+	for pid := range filter.keep {
+		if filter.keep[pid] {
+			filter.pcr[pid] = false
+		}
+	}
+	
+	// a changed program list needs a new PAT version, even if the upstream PAT did not change
+	if filter.version < 0 {
+		filter.version = psi.table.Version
+	} else if string(entries) != string(filter.programs) {
+		filter.version = (filter.version + 1) & 0x1f
+	}
+	filter.programs = entries
+	tsid := psi.table.TransportStreamId
+	pat := append([]byte{tableIdPat, 0xb0, 0x00, byte(tsid >> 8), byte(tsid), 0xc1 | byte(filter.version) << 1, 0x00, 0x00}, entries...)
+	filter.tables[PatPid] = append([]byte{0x00}, sealSection(pat)...)
+	for pid, sections := range pmts {
+		filter.tables[pid] = append([]byte{0x00}, sections...)
+	}
+}
+
+// apply filters a batch and returns the result.
+// The result can span several batches, or be empty.
+// Each returned batch has a reference count of 1.
+func (filter *outputFilter) apply(psi *psi, batch *Batch) []*Batch {
+	if filter.generation != psi.generation {
+		filter.rebuild(psi)
+	}
+	
+	output := []*Batch{NewBatch()}
+	emit := func(packet Packet) {
+		last := output[len(output) - 1]
+		if last.Full() {
+			last = NewBatch()
+			output = append(output, last)
+		}
+		last.Append(packet)
+	}
+	for _, packet := range batch.Packets {
+		pid := packet.Pid()
+		if table, ok := filter.tables[pid]; ok {
+			// replace the original tables at the start of each section
+			if packet.PayloadStart() {
+				filter.send(pid, table, emit)
+			}
+		} else if filter.keep[pid] {
+			emit(packet)
+		} else if filter.pcr[pid] {
+			if _, ok := packet.Pcr(); ok {
+				emit(filter.strip(packet))
+			}
+		}
+	}
+	return output
+}
+
+// send splits a table into packets.
+func (filter *outputFilter) send(pid uint16, table []byte, emit func(Packet)) {
+	packet := Packet(filter.scratch[:])
+	start := true
+	for len(table) > 0 {
+		packet[0] = SyncByte
+		packet[1] = byte(pid >> 8) & 0x1f
+		if start {
+			packet[1] |= 0x40
+		}
+		packet[2] = byte(pid)
+		packet[3] = 0x10 | filter.counters[pid]
+		filter.counters[pid] = (filter.counters[pid] + 1) & 0x0f
+		count := copy(packet[4:], table)
+		for i := 4 + count; i < PacketSize; i++ {
+			packet[i] = 0xff
+		}
+		emit(packet)
+		table = table[count:]
+		start = false
+	}
+}
+
+// strip reduces a packet to its PCR, for PCR PIDs that are not sent otherwise.
+func (filter *outputFilter) strip(packet Packet) Packet {
+	stripped := Packet(filter.scratch[:])
+	stripped[0] = SyncByte
+	stripped[1] = packet[1] & 0x1f
+	stripped[2] = packet[2]
+	// adaptation field only, the counter does not advance without payload
+	stripped[3] = 0x20
+	stripped[4] = PacketSize - 5
+	// keep the discontinuity indicator and the PCR
+	stripped[5] = packet[5] & 0x90
+	copy(stripped[6:12], packet[6:12])
+	for i := 12; i < PacketSize; i++ {
+		stripped[i] = 0xff
+	}
+	return stripped
+}
+
+// filterPmt returns a copy of a program map section that only lists
+// the elementary streams that are selected.
+func filterPmt(section []byte, selected *[PidCount]bool) []byte {
+	end := len(section) - 4
+	pos := 12 + (int(section[10] & 0x0f) << 8 | int(section[11]))
+	if pos > end {
+		return nil
+	}
+	filtered := make([]byte, pos, len(section))
+	copy(filtered, section[:pos])
+	for pos + 5 <= end {
+		info := int(section[pos + 3] & 0x0f) << 8 | int(section[pos + 4])
+		if pos + 5 + info > end {
+			break
+		}
+		pid := uint16(section[pos + 1] & 0x1f) << 8 | uint16(section[pos + 2])
+		if selected[pid] {
+			filtered = append(filtered, section[pos:pos + 5 + info]...)
+		}
+		pos += 5 + info
+	}
+	return sealSection(filtered)
+}
+
+// sealSection fills in the length of a section and appends its CRC.
+func sealSection(section []byte) []byte {
+	length := len(section) + 4 - 3
+	section[1] = section[1] & 0xf0 | byte(length >> 8) & 0x0f
+	section[2] = byte(length)
+	crc := crc32Mpeg(section)
+	return append(section, byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc))
+}
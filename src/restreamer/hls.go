@@ -0,0 +1,508 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"io"
+	"fmt"
+	"sync"
+	"time"
+	"bufio"
+	"errors"
+	"strings"
+	"strconv"
+	"net/http"
+	"net/url"
+)
+
+const (
+	moduleHls = "hls"
+	//
+	eventHlsPlaylist = "playlist"
+	eventHlsVariant = "variant"
+	eventHlsSegment = "segment"
+	eventHlsGap = "gap"
+	eventHlsReset = "reset"
+	eventHlsError = "error"
+	//
+	errorHlsSegment = "segment"
+	//
+	// hlsLiveEdge is the number of segments from the end of the playlist
+	// where playback starts. The HLS spec recommends at least three.
+	hlsLiveEdge = 3
+	// hlsMaxFailures is the number of consecutive segment fetch errors
+	// after which the upstream is considered dead.
+	hlsMaxFailures = 3
+	// hlsDefaultTarget is the reload interval if the playlist doesn't specify one.
+	hlsDefaultTarget = 10 * time.Second
+)
+
+var (
+	// ErrInvalidPlaylist is thrown when an HLS playlist can't be parsed.
+	ErrInvalidPlaylist = errors.New("restreamer: invalid HLS playlist")
+	// ErrNoVariant is thrown when a master playlist contains no usable variant.
+	ErrNoVariant = errors.New("restreamer: no playable variant in HLS master playlist")
+	// ErrHlsClosed is returned when reading from a closed HLS source.
+	ErrHlsClosed = errors.New("restreamer: HLS source closed")
+)
+
+// HttpGetter is a function that fetches a remote resource over HTTP.
+type HttpGetter func(url *url.URL) (*http.Response, error)
+
+// hlsSegment is a single media segment from a playlist.
+type hlsSegment struct {
+	// sequence is the media sequence number
+	sequence int64
+	// url is the absolute segment URL
+	url *url.URL
+	// duration is the nominal segment duration
+	duration time.Duration
+}
+
+// hlsPlaylist is the parsed contents of a media playlist.
+type hlsPlaylist struct {
+	// target is the target segment duration
+	target time.Duration
+	// segments is the list of segments, in order
+	segments []hlsSegment
+	// ended is true if the playlist is complete (VOD or finished event)
+	ended bool
+}
+
+// HlsReader fetches a live HLS stream and returns the contents of its
+// transport stream segments as one continuous stream.
+//
+// If the URL points to a master playlist, the variant with the highest
+// bandwidth is selected. The media playlist is reloaded periodically and
+// new segments are fetched in sequence order. Segments that disappear
+// from the playlist before they could be fetched are skipped and logged.
+//
+// Segment data is delivered at the nominal segment rate, so downstream
+// queues are not flooded with a whole segment at once.
+type HlsReader struct {
+	// get is the HTTP getter used for playlists and segments
+	get HttpGetter
+	// playlist is the media playlist URL; replaced with the variant URL
+	// after a master playlist has been loaded
+	playlist *url.URL
+	// logger is a json logger
+	logger *ModuleLogger
+	// queue contains segments that have not been fetched yet
+	queue []hlsSegment
+	// next is the next media sequence number to be queued, -1 before the first reload
+	next int64
+	// target is the last seen target duration
+	target time.Duration
+	// ended is true if the playlist will not receive more segments
+	ended bool
+	// failures counts consecutive segment fetch errors
+	failures int
+	// lock protects body against concurrent Close()
+	lock sync.Mutex
+	// body is the body of the segment that is currently being read
+	body io.ReadCloser
+	// length is the content length of the current segment, or -1 if unknown
+	length int64
+	// position is the number of bytes read from the current segment
+	position int64
+	// duration is the nominal duration of the current segment
+	duration time.Duration
+	// started is the time when the current segment was opened
+	started time.Time
+	// closed is closed when the reader is shut down
+	closed chan struct{}
+	// shutdown protects against closing twice
+	shutdown sync.Once
+}
+
+// NewHlsReader creates an HLS source for a master or media playlist URL.
+// get is used to issue all HTTP requests.
+func NewHlsReader(playlist *url.URL, get HttpGetter, logger JsonLogger) *HlsReader {
+	return &HlsReader{
+		get: get,
+		playlist: playlist,
+		logger: &ModuleLogger{
+			Logger: logger,
+			Defaults: Dict{
+				"module": moduleHls,
+			},
+			AddTimestamp: true,
+		},
+		next: -1,
+		target: hlsDefaultTarget,
+		closed: make(chan struct{}),
+	}
+}
+
+// Read returns segment data, loading new segments as needed.
+func (reader *HlsReader) Read(data []byte) (int, error) {
+	for {
+		select {
+			case <-reader.closed:
+				return 0, ErrHlsClosed
+			default:
+		}
+		
+		if reader.body == nil {
+			err := reader.open()
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		
+		reader.pace()
+		count, err := reader.body.Read(data)
+		reader.position += int64(count)
+		if count > 0 {
+			return count, nil
+		}
+		if err == io.EOF {
+			reader.lock.Lock()
+			reader.body.Close()
+			reader.body = nil
+			reader.lock.Unlock()
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close stops the reader and aborts any pending transfer.
+func (reader *HlsReader) Close() error {
+	reader.shutdown.Do(func() {
+		close(reader.closed)
+	})
+	reader.lock.Lock()
+	if reader.body != nil {
+		reader.body.Close()
+	}
+	reader.lock.Unlock()
+	return nil
+}
+
+// pace delays reading so that a segment is delivered over its nominal duration.
+func (reader *HlsReader) pace() {
+	if reader.length <= 0 || reader.duration <= 0 {
+		return
+	}
+	due := time.Duration(float64(reader.duration) * float64(reader.position) / float64(reader.length))
+	wait := due - time.Since(reader.started)
+	if wait > 0 {
+		reader.sleep(wait)
+	}
+}
+
+// sleep waits for a while, or until the reader is closed.
+func (reader *HlsReader) sleep(wait time.Duration) {
+	timer := time.NewTimer(wait)
+	select {
+		case <-timer.C:
+		case <-reader.closed:
+			timer.Stop()
+	}
+}
+
+// open starts fetching the next segment, reloading the playlist if necessary.
+func (reader *HlsReader) open() error {
+	first := true
+	for len(reader.queue) == 0 {
+		if reader.ended {
+			return io.EOF
+		}
+		if !first {
+			// nothing new yet, the spec says to wait half a target duration
+			reader.sleep(reader.target / 2)
+			select {
+				case <-reader.closed:
+					return ErrHlsClosed
+				default:
+			}
+		}
+		first = false
+		err := reader.reload()
+		if err != nil {
+			return err
+		}
+	}
+	
+	segment := reader.queue[0]
+	reader.queue = reader.queue[1:]
+	
+	reader.logger.Log(Dict{
+		"event": eventHlsSegment,
+		"sequence": segment.sequence,
+		"url": segment.url.String(),
+	})
+	response, err := reader.get(segment.url)
+	if err == nil && response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		err = fmt.Errorf("restreamer: segment fetch returned %s", response.Status)
+	}
+	if err != nil {
+		reader.failures++
+		reader.logger.Log(Dict{
+			"event": eventHlsError,
+			"error": errorHlsSegment,
+			"sequence": segment.sequence,
+			"url": segment.url.String(),
+			"message": fmt.Sprintf("Error fetching segment %d: %s", segment.sequence, err),
+		})
+		if reader.failures >= hlsMaxFailures {
+			return err
+		}
+		// skip this segment, the caller will try the next one
+		return nil
+	}
+	reader.failures = 0
+	
+	reader.lock.Lock()
+	reader.body = response.Body
+	reader.lock.Unlock()
+	reader.length = response.ContentLength
+	reader.position = 0
+	reader.duration = segment.duration
+	reader.started = time.Now()
+	return nil
+}
+
+// reload fetches the playlist and queues all new segments.
+func (reader *HlsReader) reload() error {
+	playlist, variant, err := reader.fetch(reader.playlist)
+	if err != nil {
+		return err
+	}
+	if variant != nil {
+		// it was a master playlist, stick with the selected variant from now on
+		reader.logger.Log(Dict{
+			"event": eventHlsVariant,
+			"url": variant.String(),
+			"message": fmt.Sprintf("Selected variant %s", variant),
+		})
+		reader.playlist = variant
+		playlist, variant, err = reader.fetch(reader.playlist)
+		if err != nil {
+			return err
+		}
+		if variant != nil {
+			return ErrInvalidPlaylist
+		}
+	}
+	
+	reader.target = playlist.target
+	reader.ended = playlist.ended
+	count := len(playlist.segments)
+	if count == 0 {
+		return nil
+	}
+	first := playlist.segments[0].sequence
+	last := playlist.segments[count - 1].sequence
+	
+	if reader.next < 0 {
+		// first load: start near the live edge, or at the beginning if the playlist is complete
+		start := 0
+		if !playlist.ended && count > hlsLiveEdge {
+			start = count - hlsLiveEdge
+		}
+		reader.next = playlist.segments[start].sequence
+	} else if last + 1 < reader.next {
+		// the sequence went backwards, the packager was probably restarted
+		reader.logger.Log(Dict{
+			"event": eventHlsReset,
+			"expected": reader.next,
+			"last": last,
+			"message": fmt.Sprintf("Playlist sequence reset from %d to %d, restarting at live edge", reader.next, last),
+		})
+		start := 0
+		if count > hlsLiveEdge {
+			start = count - hlsLiveEdge
+		}
+		reader.next = playlist.segments[start].sequence
+	} else if first > reader.next {
+		// we fell behind and some segments have already expired
+		reader.logger.Log(Dict{
+			"event": eventHlsGap,
+			"expected": reader.next,
+			"first": first,
+			"message": fmt.Sprintf("Segments %d to %d missing from playlist, skipping", reader.next, first - 1),
+		})
+		reader.next = first
+	}
+	
+	for _, segment := range playlist.segments {
+		if segment.sequence >= reader.next {
+			reader.queue = append(reader.queue, segment)
+			reader.next = segment.sequence + 1
+		}
+	}
+	
+	reader.logger.Log(Dict{
+		"event": eventHlsPlaylist,
+		"url": reader.playlist.String(),
+		"first": first,
+		"last": last,
+		"queued": len(reader.queue),
+	})
+	return nil
+}
+
+// fetch loads and parses a playlist.
+// If it is a master playlist, only the URL of the best variant is returned.
+func (reader *HlsReader) fetch(location *url.URL) (*hlsPlaylist, *url.URL, error) {
+	response, err := reader.get(location)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, &UpstreamError{
+			Reason: UpstreamReasonStatus,
+			Err: ErrInvalidResponse,
+			Detail: fmt.Sprintf("playlist fetch returned %s", response.Status),
+		}
+	}
+	// redirects change the base for relative URLs
+	base := location
+	if response.Request != nil && response.Request.URL != nil {
+		base = response.Request.URL
+	}
+	return parseHlsPlaylist(response.Body, base)
+}
+
+// parseHlsPlaylist parses an m3u8 playlist.
+// Returns either a media playlist, or the URL of the variant
+// with the highest bandwidth if it is a master playlist.
+func parseHlsPlaylist(input io.Reader, base *url.URL) (*hlsPlaylist, *url.URL, error) {
+	scanner := bufio.NewScanner(input)
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "#EXTM3U" {
+		return nil, nil, ErrInvalidPlaylist
+	}
+	
+	playlist := &hlsPlaylist{
+		target: hlsDefaultTarget,
+	}
+	var sequence int64
+	var duration time.Duration
+	
+	master := false
+	var variant *url.URL
+	var bandwidth int64 = -1
+	var inf map[string]string
+	
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+			case line == "":
+				// ignore
+			case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+				master = true
+				inf = parseHlsAttributes(line[len("#EXT-X-STREAM-INF:"):])
+			case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+				seconds, err := strconv.ParseFloat(line[len("#EXT-X-TARGETDURATION:"):], 64)
+				if err == nil && seconds > 0 {
+					playlist.target = time.Duration(seconds * float64(time.Second))
+				}
+			case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+				value, err := strconv.ParseInt(line[len("#EXT-X-MEDIA-SEQUENCE:"):], 10, 64)
+				if err != nil {
+					return nil, nil, ErrInvalidPlaylist
+				}
+				sequence = value
+			case strings.HasPrefix(line, "#EXTINF:"):
+				value := line[len("#EXTINF:"):]
+				if comma := strings.IndexByte(value, ','); comma >= 0 {
+					value = value[:comma]
+				}
+				seconds, err := strconv.ParseFloat(value, 64)
+				if err == nil {
+					duration = time.Duration(seconds * float64(time.Second))
+				}
+			case line == "#EXT-X-ENDLIST":
+				playlist.ended = true
+			case strings.HasPrefix(line, "#"):
+				// unsupported tag or comment
+			default:
+				// a URI line
+				location, err := base.Parse(line)
+				if err != nil {
+					return nil, nil, err
+				}
+				if inf != nil {
+					value, _ := strconv.ParseInt(inf["BANDWIDTH"], 10, 64)
+					if value > bandwidth {
+						bandwidth = value
+						variant = location
+					}
+					inf = nil
+				} else if !master {
+					playlist.segments = append(playlist.segments, hlsSegment{
+						sequence: sequence,
+						url: location,
+						duration: duration,
+					})
+					sequence++
+					duration = 0
+				}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	
+	if master {
+		if variant == nil {
+			return nil, nil, ErrNoVariant
+		}
+		return nil, variant, nil
+	}
+	return playlist, nil, nil
+}
+
+// parseHlsAttributes splits an attribute list like
+// BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2" into a map.
+func parseHlsAttributes(list string) map[string]string {
+	attributes := make(map[string]string)
+	for len(list) > 0 {
+		equals := strings.IndexByte(list, '=')
+		if equals < 0 {
+			break
+		}
+		key := strings.TrimSpace(list[:equals])
+		list = list[equals + 1:]
+		var value string
+		if strings.HasPrefix(list, "\"") {
+			end := strings.IndexByte(list[1:], '"')
+			if end < 0 {
+				value = list[1:]
+				list = ""
+			} else {
+				value = list[1:end + 1]
+				list = list[end + 2:]
+			}
+		} else {
+			end := strings.IndexByte(list, ',')
+			if end < 0 {
+				end = len(list)
+			}
+			value = list[:end]
+			list = list[end:]
+		}
+		attributes[key] = value
+		list = strings.TrimPrefix(list, ",")
+	}
+	return attributes
+}
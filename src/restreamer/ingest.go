@@ -0,0 +1,231 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"strings"
+	"net/http"
+	"crypto/subtle"
+)
+
+const (
+	moduleIngest = "ingest"
+	//
+	eventIngestError = "error"
+	eventIngestPublish = "publish"
+	eventIngestStarted = "started"
+	eventIngestStopped = "stopped"
+	//
+	errorIngestForbidden = "forbidden"
+	errorIngestBusy = "busy"
+	errorIngestMethod = "method"
+)
+
+// Ingest accepts a transport stream pushed by an encoder through an
+// HTTP PUT or POST request, and feeds it into a Streamer.
+//
+// GET and HEAD requests on the same resource are passed on to the streamer,
+// so viewers and the publisher can use the same URL.
+//
+// Clients stay connected when the publisher goes away, for the grace period
+// of the streamer. Only one publisher is accepted at a time. If a stream key is configured,
+// the publisher must supply it, either as the "key" query parameter or
+// as a bearer token in the Authorization header.
+type Ingest struct {
+	// streamer is the attached packet distributor
+	streamer *Streamer
+	// key is the stream key, or the empty string if no authentication is required
+	key string
+	// publishing is true while a publisher is connected
+	publishing AtomicBool
+	// ReadTimeout is the time after which a publisher that stopped sending
+	// is disconnected, so another one can take over. 0 waits forever.
+	ReadTimeout time.Duration
+	// queue is the packet queue feeding the streamer, shared by all publishers
+	queue chan *Batch
+	// stats is the statistics collector for this stream
+	stats Collector
+	// logger is a json logger
+	logger *ModuleLogger
+}
+
+// NewIngest creates a push ingest endpoint for a streamer.
+// key is the stream key; pass the empty string to disable authentication.
+// qsize is the input queue size, in packets.
+// To start accepting publishers and viewers, call Start().
+func NewIngest(streamer *Streamer, key string, qsize uint) *Ingest {
+	logger := &ModuleLogger{
+		Logger: &ConsoleLogger{},
+		Defaults: Dict{
+			"module": moduleIngest,
+		},
+		AddTimestamp: true,
+	}
+	ingest := &Ingest{
+		streamer: streamer,
+		key: key,
+		publishing: AtomicFalse,
+		queue: make(chan *Batch, BatchQueueSize(qsize)),
+		stats: &DummyCollector{},
+		logger: logger,
+	}
+	return ingest
+}
+
+// Start starts the streamer.
+// Call it after the ingest and the streamer are set up.
+//
+// Do not call this method multiple times!
+func (ingest *Ingest) Start() {
+	go ingest.streamer.Stream(ingest.queue)
+}
+
+// SetLogger assigns a logger
+func (ingest *Ingest) SetLogger(logger JsonLogger) {
+	ingest.logger.Logger = logger
+}
+
+// SetCollector assigns a stats collector
+func (ingest *Ingest) SetCollector(stats Collector) {
+	ingest.stats = stats
+}
+
+// Connected returns true if a publisher is connected.
+func (ingest *Ingest) Connected() bool {
+	return LoadBool(&ingest.publishing)
+}
+
+// ServeHTTP handles publisher and viewer requests.
+// Satisfies the http.Handler interface, so it can be used in an HTTP server.
+func (ingest *Ingest) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+		case "GET":
+			fallthrough
+		case "HEAD":
+			ingest.streamer.ServeHTTP(writer, request)
+		case "PUT":
+			fallthrough
+		case "POST":
+			ingest.publish(writer, request)
+		default:
+			ingest.logger.Log(Dict{
+				"event": eventIngestError,
+				"error": errorIngestMethod,
+				"remote": request.RemoteAddr,
+				"method": request.Method,
+				"message": fmt.Sprintf("Unsupported method %s from %s", request.Method, request.RemoteAddr),
+			})
+			writer.Header().Set("Allow", "GET, HEAD, PUT, POST")
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// authorized checks the stream key supplied by a publisher.
+func (ingest *Ingest) authorized(request *http.Request) bool {
+	if ingest.key == "" {
+		return true
+	}
+	key := request.URL.Query().Get("key")
+	if auth := request.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(ingest.key)) == 1
+}
+
+// publish reads packets from the request body and feeds them into the streamer.
+func (ingest *Ingest) publish(writer http.ResponseWriter, request *http.Request) {
+	if !ingest.authorized(request) {
+		ingest.logger.Log(Dict{
+			"event": eventIngestError,
+			"error": errorIngestForbidden,
+			"remote": request.RemoteAddr,
+			"message": fmt.Sprintf("Refusing publisher %s, invalid stream key", request.RemoteAddr),
+		})
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !CompareAndSwapBool(&ingest.publishing, false, true) {
+		ingest.logger.Log(Dict{
+			"event": eventIngestError,
+			"error": errorIngestBusy,
+			"remote": request.RemoteAddr,
+			"message": fmt.Sprintf("Refusing publisher %s, stream is already being published", request.RemoteAddr),
+		})
+		writer.WriteHeader(http.StatusConflict)
+		return
+	}
+	
+	ingest.logger.Log(Dict{
+		"event": eventIngestPublish,
+		"remote": request.RemoteAddr,
+		"message": fmt.Sprintf("Accepting stream from %s", request.RemoteAddr),
+	})
+	
+	// set as soon as the first packet has been received
+	connected := false
+	var err error
+	
+	// a stalled publisher must not keep the stream forever
+	var body io.Reader = request.Body
+	if ingest.ReadTimeout > 0 {
+		timeout := newTimeoutReader(newRequestBody(writer, request), ingest.ReadTimeout)
+		defer timeout.Stop()
+		body = timeout
+	}
+	reader := NewPacketReader(body)
+	reader.SetCollector(ingest.stats)
+	for err == nil {
+		var batch *Batch
+		batch, err = reader.ReadBatch()
+		if err == nil {
+			// report connection up
+			if !connected {
+				connected = true
+				ingest.streamer.Connect()
+				ingest.stats.SourceConnected()
+				ingest.logger.Log(Dict{
+					"event": eventIngestStarted,
+					"remote": request.RemoteAddr,
+					"packetsize": reader.Stride(),
+				})
+			}
+			
+			// report the packets
+			ingest.stats.PacketsReceived(batch.Len())
+			
+			ingest.queue<- batch
+		}
+	}
+	
+	// and the publisher is gone
+	if connected {
+		ingest.streamer.Close()
+		ingest.stats.SourceDisconnected()
+	}
+	ingest.logger.Log(Dict{
+		"event": eventIngestStopped,
+		"remote": request.RemoteAddr,
+		"message": fmt.Sprintf("Publisher %s disconnected: %s", request.RemoteAddr, err),
+	})
+	
+	StoreBool(&ingest.publishing, false)
+	
+	writer.WriteHeader(http.StatusNoContent)
+}
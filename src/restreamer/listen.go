@@ -0,0 +1,172 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"errors"
+)
+
+const (
+	moduleAcceptor = "acceptor"
+	//
+	eventAcceptorError = "error"
+	eventAcceptorAccepted = "accepted"
+	eventAcceptorTakeover = "takeover"
+	eventAcceptorReplaced = "replaced"
+	//
+	errorAcceptorAccept = "accept"
+	//
+	// acceptorRetryDelay is the pause after a failed accept() call,
+	// to avoid spinning when the process runs out of file descriptors.
+	acceptorRetryDelay = 1 * time.Second
+)
+
+var (
+	// ErrAcceptTimeout is thrown when no upstream connected to a listening socket in time.
+	ErrAcceptTimeout = errors.New("restreamer: no incoming upstream connection")
+	// ErrAcceptCancelled is thrown when waiting for an upstream connection was cancelled.
+	ErrAcceptCancelled = errors.New("restreamer: stopped waiting for an upstream connection")
+)
+
+// TcpAcceptor listens on a TCP socket and accepts upstream connections
+// from encoders that can only connect outward.
+//
+// Only one connection is used at a time. When a new connection comes in,
+// the previously active connection is closed, so a stale connection from
+// a dead encoder is replaced as soon as the encoder reconnects.
+type TcpAcceptor struct {
+	// listener is the listening socket
+	listener net.Listener
+	// lock protects pending and active
+	lock sync.Mutex
+	// pending holds the last accepted connection until it is picked up
+	pending net.Conn
+	// active is the connection that was last handed out
+	active net.Conn
+	// ready is signalled when a new connection is pending
+	ready chan struct{}
+	// logger is a json logger
+	logger *ModuleLogger
+}
+
+// NewTcpAcceptor binds a listening socket to address and starts accepting connections.
+func NewTcpAcceptor(address string, logger JsonLogger) (*TcpAcceptor, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	acceptor := &TcpAcceptor{
+		listener: listener,
+		ready: make(chan struct{}, 1),
+		logger: &ModuleLogger{
+			Logger: logger,
+			Defaults: Dict{
+				"module": moduleAcceptor,
+				"listen": listener.Addr().String(),
+			},
+			AddTimestamp: true,
+		},
+	}
+	go acceptor.accept()
+	return acceptor, nil
+}
+
+// accept loops over incoming connections and queues them for pickup.
+func (acceptor *TcpAcceptor) accept() {
+	for {
+		conn, err := acceptor.listener.Accept()
+		if err != nil {
+			acceptor.logger.Log(Dict{
+				"event": eventAcceptorError,
+				"error": errorAcceptorAccept,
+				"message": err.Error(),
+			})
+			time.Sleep(acceptorRetryDelay)
+			continue
+		}
+		acceptor.logger.Log(Dict{
+			"event": eventAcceptorAccepted,
+			"remote": conn.RemoteAddr().String(),
+			"message": fmt.Sprintf("Accepted upstream connection from %s", conn.RemoteAddr()),
+		})
+		
+		acceptor.lock.Lock()
+		// the new connection takes over from the active one
+		if acceptor.active != nil {
+			acceptor.logger.Log(Dict{
+				"event": eventAcceptorTakeover,
+				"remote": acceptor.active.RemoteAddr().String(),
+				"message": fmt.Sprintf("Closing upstream connection from %s", acceptor.active.RemoteAddr()),
+			})
+			acceptor.active.Close()
+			acceptor.active = nil
+		}
+		// and from any connection that was not picked up yet
+		if acceptor.pending != nil {
+			acceptor.logger.Log(Dict{
+				"event": eventAcceptorReplaced,
+				"remote": acceptor.pending.RemoteAddr().String(),
+				"message": fmt.Sprintf("Dropping unused upstream connection from %s", acceptor.pending.RemoteAddr()),
+			})
+			acceptor.pending.Close()
+		}
+		acceptor.pending = conn
+		acceptor.lock.Unlock()
+		
+		select {
+			case acceptor.ready<- struct{}{}:
+			default:
+		}
+	}
+}
+
+// Accept waits for an incoming connection and returns it.
+// If timeout is non-zero, ErrAcceptTimeout is returned when no
+// connection came in during that time. ErrAcceptCancelled is returned
+// when cancel is closed first.
+func (acceptor *TcpAcceptor) Accept(timeout time.Duration, cancel <-chan struct{}) (net.Conn, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		acceptor.lock.Lock()
+		conn := acceptor.pending
+		if conn != nil {
+			acceptor.pending = nil
+			acceptor.active = conn
+		}
+		acceptor.lock.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		
+		select {
+			case <-acceptor.ready:
+			case <-expired:
+				return nil, ErrAcceptTimeout
+			case <-cancel:
+				return nil, ErrAcceptCancelled
+		}
+	}
+}
@@ -0,0 +1,308 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// monitorTableTimeout is the maximum interval between PAT and PMT packets
+	monitorTableTimeout = 500 * time.Millisecond
+	// monitorCheckInterval is the interval between PID timeout checks
+	monitorCheckInterval = 100 * time.Millisecond
+	// MonitorDefaultPidTimeout is the default time after which a missing
+	// elementary stream is reported
+	MonitorDefaultPidTimeout = 5 * time.Second
+	// monitorPcrWindow is the span of PCR time over which bitrate,
+	// interval and jitter are measured
+	monitorPcrWindow = PcrClock
+	// monitorMaxPcrGap is the largest PCR step that is not a discontinuity
+	monitorMaxPcrGap = PcrClock
+	// monitorPcrRepetition is the longest allowed interval between two PCRs,
+	// longer intervals are reported as PCR repetition errors
+	monitorPcrRepetition = PcrClock * 40 / 1000
+	// pcrModulus is the range of PCR values, they wrap around after about 26 hours
+	pcrModulus = (1 << 33) * 300
+)
+
+// PcrStatistics is a measurement of the timing of a stream, based on its PCRs.
+type PcrStatistics struct {
+	// Bitrate is the transport stream rate in bits per second, including stuffing
+	Bitrate uint64
+	// Interval is the average time between two PCRs
+	Interval time.Duration
+	// MaxInterval is the longest time between two PCRs
+	MaxInterval time.Duration
+	// Jitter is the difference between the earliest and the latest arrival
+	// of the PCRs, compared to the time they carry
+	Jitter time.Duration
+}
+
+// monitor checks the integrity of a transport stream, following the first
+// and second priority checks of ETSI TR 101 290 that can be done without
+// decoding: continuity counter errors, transport errors, scrambled packets,
+// PAT, PMT and elementary stream PIDs that stop arriving, and PCR repetition.
+//
+// Errors are reported per PID to a stats collector.
+// When the upstream reconnects, continuity and timeouts are tracked from scratch.
+type monitor struct {
+	// timeout is the time after which a missing elementary stream is reported
+	timeout time.Duration
+	// seen is true for PIDs that have been received since the last reconnect
+	seen [PidCount]bool
+	// last is the last continuity counter of each PID
+	last [PidCount]uint8
+	// duplicate is true if the last packet of a PID was a duplicate
+	duplicate [PidCount]bool
+	// arrival is the time when each PID was last received, relative to start
+	arrival [PidCount]time.Duration
+	// missing is true for PIDs that have timed out and not come back yet
+	missing [PidCount]bool
+	// start is the reference time for arrival
+	start time.Time
+	// check is the time of the next timeout check
+	check time.Time
+	// pcrPid is the PID that PCRs are taken from, -1 if none is known yet
+	pcrPid int
+	// pcrCount is the number of PCRs in the current measurement window,
+	// 0 if the window has not started yet
+	pcrCount int
+	// pcrStart is the first PCR of the window
+	pcrStart uint64
+	// pcrLast is the last PCR
+	pcrLast uint64
+	// pcrPackets is the number of packets since the start of the window
+	pcrPackets uint64
+	// pcrMaxInterval is the longest PCR interval in the window, in PCR units
+	pcrMaxInterval uint64
+	// pcrEarliest and pcrLatest are the extremes of the arrival time
+	// of each PCR, minus the PCR time since the start of the window
+	pcrEarliest time.Duration
+	pcrLatest time.Duration
+	// psi tells which PIDs are expected
+	psi *psi
+	// stats is the statistics collector for this stream
+	stats Collector
+	// logger is the logger of the stream
+	logger JsonLogger
+}
+
+// newMonitor creates a monitor that expects the PIDs announced by psi.
+func newMonitor(psi *psi, logger JsonLogger) *monitor {
+	return &monitor{
+		timeout: MonitorDefaultPidTimeout,
+		pcrPid: -1,
+		start: time.Now(),
+		psi: psi,
+		stats: &DummyCollector{},
+		logger: logger,
+	}
+}
+
+// inspect checks all packets of a batch.
+func (monitor *monitor) inspect(batch *Batch) {
+	now := time.Now()
+	stamp := now.Sub(monitor.start)
+	
+	// scrambled packets are reported in runs, to keep the overhead low
+	var scrambled uint16
+	count := 0
+	for _, packet := range batch.Packets {
+		pid := packet.Pid()
+		monitor.arrival[pid] = stamp
+		monitor.pcrPackets++
+		if packet.TransportError() {
+			// the rest of the header can't be trusted
+			monitor.stats.TransportError(pid)
+			continue
+		}
+		if monitor.pcrPid == -1 || int(pid) == monitor.pcrPid {
+			if pcr, ok := packet.Pcr(); ok {
+				monitor.pcrPid = int(pid)
+				monitor.timing(pcr, packet.Discontinuity(), stamp)
+			}
+		}
+		if pid == NullPid {
+			continue
+		}
+		if packet.Scrambled() {
+			if count > 0 && pid != scrambled {
+				monitor.stats.PacketsScrambled(scrambled, count)
+				count = 0
+			}
+			scrambled = pid
+			count++
+		}
+		monitor.continuity(pid, packet)
+	}
+	if count > 0 {
+		monitor.stats.PacketsScrambled(scrambled, count)
+	}
+	
+	if now.After(monitor.check) {
+		monitor.program()
+		monitor.timeouts(stamp)
+		monitor.check = now.Add(monitorCheckInterval)
+	}
+}
+
+// resume restarts tracking when the upstream reconnects.
+// Must be called from the goroutine that feeds the monitor.
+func (monitor *monitor) resume() {
+	stamp := time.Since(monitor.start)
+	for pid := range monitor.arrival {
+		monitor.seen[pid] = false
+		monitor.arrival[pid] = stamp
+	}
+	monitor.pcrCount = 0
+}
+
+// program selects the PCR PID of the first program, once it is known.
+// Until then, PCRs are taken from the first PID that carries them.
+func (monitor *monitor) program() {
+	for _, program := range monitor.psi.table.Programs {
+		if program.Version >= 0 {
+			if int(program.PcrPid) != monitor.pcrPid && program.PcrPid != NullPid {
+				monitor.pcrPid = int(program.PcrPid)
+				monitor.pcrCount = 0
+			}
+			return
+		}
+	}
+}
+
+// timing adds a PCR to the measurement window, and reports the
+// bitrate, interval and jitter when the window is complete.
+//
+// Packets are counted from one PCR to the next, so the bitrate is the
+// rate that the stream was multiplexed at, independent of the network.
+// Jitter is measured on the arrival of the batch that contains a PCR.
+// Intervals over 40ms are reported as PCR repetition errors, steps over
+// monitorMaxPcrGap are treated as discontinuities.
+func (monitor *monitor) timing(pcr uint64, discontinuity bool, arrival time.Duration) {
+	if monitor.pcrCount > 0 {
+		interval := (pcr + pcrModulus - monitor.pcrLast) % pcrModulus
+		if discontinuity || interval == 0 || interval > monitorMaxPcrGap {
+			// the clock jumped, start over
+			monitor.pcrCount = 0
+		} else if interval > monitorPcrRepetition {
+			monitor.stats.PcrError(uint16(monitor.pcrPid))
+		}
+	}
+	if monitor.pcrCount == 0 {
+		monitor.pcrCount = 1
+		monitor.pcrStart = pcr
+		monitor.pcrLast = pcr
+		monitor.pcrPackets = 1
+		monitor.pcrMaxInterval = 0
+		monitor.pcrEarliest = arrival
+		monitor.pcrLatest = arrival
+		return
+	}
+	
+	interval := (pcr + pcrModulus - monitor.pcrLast) % pcrModulus
+	if interval > monitor.pcrMaxInterval {
+		monitor.pcrMaxInterval = interval
+	}
+	monitor.pcrLast = pcr
+	monitor.pcrCount++
+	elapsed := (pcr + pcrModulus - monitor.pcrStart) % pcrModulus
+	offset := arrival - pcrTime(elapsed)
+	if offset < monitor.pcrEarliest {
+		monitor.pcrEarliest = offset
+	}
+	if offset > monitor.pcrLatest {
+		monitor.pcrLatest = offset
+	}
+	
+	if elapsed >= monitorPcrWindow {
+		// the packet with the PCR belongs to the next window
+		packets := monitor.pcrPackets - 1
+		monitor.stats.PcrMeasured(PcrStatistics{
+			Bitrate: packets * PacketSize * 8 * PcrClock / elapsed,
+			Interval: pcrTime(elapsed / uint64(monitor.pcrCount - 1)),
+			MaxInterval: pcrTime(monitor.pcrMaxInterval),
+			Jitter: monitor.pcrLatest - monitor.pcrEarliest,
+		})
+		monitor.pcrCount = 1
+		monitor.pcrStart = pcr
+		monitor.pcrPackets = 1
+		monitor.pcrMaxInterval = 0
+		monitor.pcrEarliest = arrival
+		monitor.pcrLatest = arrival
+	}
+}
+
+// continuity verifies the continuity counter of a packet.
+//
+// The counter must increase by one with each packet that carries payload.
+// A single duplicate packet is allowed, and a discontinuity indicator
+// allows any value.
+func (monitor *monitor) continuity(pid uint16, packet Packet) {
+	counter := packet.ContinuityCounter()
+	if !monitor.seen[pid] || packet.Discontinuity() {
+		monitor.seen[pid] = true
+		monitor.last[pid] = counter
+		monitor.duplicate[pid] = false
+		return
+	}
+	if !packet.HasPayload() {
+		// the counter does not advance without payload
+		return
+	}
+	last := monitor.last[pid]
+	if counter == last {
+		if monitor.duplicate[pid] {
+			monitor.stats.ContinuityError(pid)
+		}
+		monitor.duplicate[pid] = true
+		return
+	}
+	if counter != (last + 1) & 0x0f {
+		monitor.stats.ContinuityError(pid)
+	}
+	monitor.last[pid] = counter
+	monitor.duplicate[pid] = false
+}
+
+// timeouts reports expected PIDs that have not been received for too long.
+// Each PID is reported once, until it comes back.
+func (monitor *monitor) timeouts(stamp time.Duration) {
+	monitor.psi.expected(func(pid uint16, table bool) {
+		timeout := monitor.timeout
+		if table {
+			timeout = monitorTableTimeout
+		}
+		if stamp - monitor.arrival[pid] <= timeout {
+			monitor.missing[pid] = false
+			return
+		}
+		if monitor.missing[pid] {
+			return
+		}
+		monitor.missing[pid] = true
+		monitor.stats.PidTimeout(pid)
+		monitor.logger.Log(Dict{
+			"event": eventStreamerPidTimeout,
+			"pid": pid,
+			"timeout": timeout.Seconds(),
+			"message": fmt.Sprintf("PID %d has not been received for %0.1f seconds", pid, timeout.Seconds()),
+		})
+	})
+}
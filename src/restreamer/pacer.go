@@ -0,0 +1,109 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"time"
+)
+
+const (
+	// PacerDefaultBitrate is the playback rate for files without PCR, in bits per second
+	PacerDefaultBitrate = 2000000
+	// pacerMinSleep is the minimum amount of time the player gets ahead before it sleeps
+	pacerMinSleep = 10 * time.Millisecond
+	// pacerMaxPcrGap is the largest PCR step that is considered continuous.
+	// Larger steps and steps backwards are treated as discontinuities.
+	pacerMaxPcrGap = 2 * PcrClock
+	// pacerMaxLag is how far playback may fall behind before the clock is reset,
+	// instead of catching up with a burst
+	pacerMaxLag = 1 * time.Second
+)
+
+// pacer keeps track of the playing time of a TS stream that is played in real time.
+//
+// The stream clock follows the PCRs on the first PID that carries them.
+// Until the first PCR is found, or if there is none, each packet advances
+// the clock by the playing time at a fixed bitrate.
+// PCR discontinuities do not affect the stream clock.
+type pacer struct {
+	// interval is the playing time of one packet, for streams without PCR
+	interval time.Duration
+	// start is the wall clock time of stream time 0
+	start time.Time
+	// clock is the stream time of the current packet
+	clock time.Duration
+	// pcrPid is the PID that carries the PCR used for pacing, or -1 if none was found yet
+	pcrPid int
+	// pcr is the last PCR on pcrPid
+	pcr uint64
+	// offset maps PCR time to stream time, it changes on each discontinuity
+	offset time.Duration
+	// synced is true when offset is valid
+	synced bool
+}
+
+// newPacer creates a pacer that starts now.
+// bitrate is the playback rate for streams without PCR, in bits per second.
+// 0 selects PacerDefaultBitrate.
+func newPacer(bitrate uint64) *pacer {
+	if bitrate == 0 {
+		bitrate = PacerDefaultBitrate
+	}
+	return &pacer{
+		interval: time.Duration(PacketSize * 8 * uint64(time.Second) / bitrate),
+		start: time.Now(),
+		pcrPid: -1,
+	}
+}
+
+// schedule advances the stream clock to the playing time of a packet.
+func (pacer *pacer) schedule(packet Packet) {
+	pid := int(packet.Pid())
+	pcr, ok := packet.Pcr()
+	if ok && (pacer.pcrPid == -1 || pid == pacer.pcrPid) {
+		if !pacer.synced || pcr < pacer.pcr || pcr - pacer.pcr > pacerMaxPcrGap {
+			// first PCR or discontinuity, continue from the current position
+			pacer.offset = pacer.clock - pcrTime(pcr)
+			pacer.synced = true
+		}
+		pacer.pcrPid = pid
+		pacer.pcr = pcr
+		pacer.clock = pcrTime(pcr) + pacer.offset
+	} else if pacer.pcrPid == -1 {
+		pacer.clock += pacer.interval
+	}
+}
+
+// due returns the time until the current packet should be played.
+// Waits shorter than pacerMinSleep are reported as 0, so the player does not
+// sleep for every packet. If playback fell behind too far, the clock is reset
+// instead of catching up.
+func (pacer *pacer) due() time.Duration {
+	wait := pacer.start.Add(pacer.clock).Sub(time.Now())
+	if wait < -pacerMaxLag {
+		pacer.start = time.Now().Add(-pacer.clock)
+	}
+	if wait <= pacerMinSleep {
+		return 0
+	}
+	return wait
+}
+
+// pcrTime converts a PCR value to a duration.
+func pcrTime(pcr uint64) time.Duration {
+	return time.Duration(pcr * uint64(time.Microsecond) / (PcrClock / 1000000))
+}
@@ -24,6 +24,10 @@ import (
 const (
 	// PacketSize is the TS packet size (188 bytes)
 	PacketSize = 188
+	// M2tsPacketSize is the size of an M2TS packet, a TS packet with a 4 byte timecode prefix
+	M2tsPacketSize = 192
+	// RsPacketSize is the size of a TS packet followed by 16 bytes of Reed-Solomon parity
+	RsPacketSize = 204
 	// SyncByte is the byte value of the TS synchronization code (0x47)
 	SyncByte = 0x47
 )
@@ -37,6 +41,9 @@ type Packet []byte
 //
 // If a sync byte can't be found among the first 188 bytes,
 // no packets are returned
+//
+// Streams should be read with a PacketReader instead, which is faster
+// and handles sync loss and other packet sizes.
 func ReadPacket(reader io.Reader) (Packet, error) {
 	garbage := make(Packet, PacketSize)
 	offset := 0
@@ -27,6 +27,7 @@ import (
 	"path"
 	"errors"
 	"strconv"
+	"net"
 	"net/http"
 	"net/url"
 	"hash/fnv"
@@ -51,8 +52,14 @@ var (
 type Proxy struct {
 	// the upstream URL (file/http/https)
 	url *url.URL
-	// HTTP client timeout
-	timeout time.Duration
+	// HTTP client, with timeout
+	getter *http.Client
+	// connection dialer, with timeout and binding
+	dialer *net.Dialer
+	// HTTP transport, nil while the default transport is used
+	transport *http.Transport
+	// upstream request headers and authentication
+	credentials Credentials
 	// maximum size of remote resource
 	limit int64
 	// fetch lock
@@ -89,7 +96,12 @@ func NewProxy(uri string, timeout uint, cache uint) (*Proxy, error) {
 	
 	return &Proxy{
 		url: parsed,
-		timeout: time.Duration(timeout) * time.Second,
+		getter: &http.Client{
+			Timeout: time.Duration(timeout) * time.Second,
+		},
+		dialer: &net.Dialer{
+			Timeout: time.Duration(timeout) * time.Second,
+		},
 		// TODO make this configurable
 		limit: proxyDefaultLimit,
 		stale: time.Duration(cache) * time.Second,
@@ -113,11 +125,47 @@ func (proxy *Proxy) SetStatistics(stats Statistics) {
 	proxy.stats = stats
 }
 
+// Assigns headers and authentication data for upstream requests
+func (proxy *Proxy) SetCredentials(credentials Credentials) {
+	proxy.credentials = credentials
+}
+
+// Assigns TLS settings for https upstreams
+func (proxy *Proxy) SetTls(loader *TlsLoader) {
+	proxy.customTransport().TLSClientConfig = loader.ClientConfig()
+}
+
+// Assigns the local address and interface for upstream connections
+func (proxy *Proxy) SetBinding(binding Binding) error {
+	err := binding.Apply(proxy.dialer)
+	if err != nil {
+		return err
+	}
+	proxy.customTransport()
+	return nil
+}
+
+// customTransport replaces the default HTTP transport with one that
+// connects through our dialer, and returns it.
+func (proxy *Proxy) customTransport() *http.Transport {
+	if proxy.transport == nil {
+		proxy.transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: proxy.dialer.Dial,
+			TLSHandshakeTimeout: proxy.dialer.Timeout,
+		}
+		proxy.getter.Transport = proxy.transport
+	}
+	return proxy.transport
+}
+
 // Get opens the remote or local resource specified by the URL and returns a reader, 
 // upstream HTTP headers, an HTTP status code and the resource data length, or -1 if no length is available.
 // Local resources contain guessed data
 // Supported schemas: file, http and https.
-func Get(url *url.URL, timeout time.Duration) (io.Reader, http.Header, int, int64, error) {
+// getter is the HTTP client to use.
+// credentials are applied to HTTP requests, pass nil to send a bare request.
+func Get(url *url.URL, getter *http.Client, credentials *Credentials) (io.Reader, http.Header, int, int64, error) {
 	var status int = http.StatusNotFound
 	var reader io.Reader = nil
 	var header http.Header = make(http.Header)
@@ -153,10 +201,15 @@ func Get(url *url.URL, timeout time.Duration) (io.Reader, http.Header, int, int6
 		}
 	} else {
 		log.Printf("Fetching %s\n", url)
-		getter := &http.Client {
-			Timeout: timeout,
+		var response *http.Response
+		var request *http.Request
+		request, err = http.NewRequest("GET", url.String(), nil)
+		if err == nil && credentials != nil {
+			err = credentials.Apply(request)
+		}
+		if err == nil {
+			response, err = getter.Do(request)
 		}
-		response, err := getter.Get(url.String())
 		if (err == nil) {
 			status = response.StatusCode
 			reader = response.Body
@@ -180,7 +233,7 @@ func (proxy *Proxy) cache() error {
 	now := time.Now()
 	if now.Sub(proxy.last) > proxy.stale {
 		// get a getter
-		getter, header, status, length, err := Get(proxy.url, proxy.timeout)
+		getter, header, status, length, err := Get(proxy.url, proxy.getter, &proxy.credentials)
 		
 		// no length, no cache
 		if length < 0 {
@@ -285,7 +338,7 @@ func (proxy *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 		// non-cached
 		
 		// get a getter
-		getter, header, status, length, err := Get(proxy.url, proxy.timeout)
+		getter, header, status, length, err := Get(proxy.url, proxy.getter, &proxy.credentials)
 		
 		if err != nil {
 			log.Printf("Error connecting to upstream: %s", err)
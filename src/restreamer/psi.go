@@ -0,0 +1,539 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"fmt"
+	"sync"
+	"bytes"
+)
+
+const (
+	// PatPid is the PID of the program association table
+	PatPid = 0x0000
+	// tableIdPat is the table ID of program association sections
+	tableIdPat = 0x00
+	// tableIdPmt is the table ID of program map sections
+	tableIdPmt = 0x02
+	// psiMaxSection is the maximum length of a PSI section, including the header
+	psiMaxSection = 1024
+	// psiMinSection is the length of a long section header and the CRC
+	psiMinSection = 12
+)
+
+// ProgramTable is a snapshot of the programs that a transport stream carries,
+// as announced by the program association and program map tables.
+type ProgramTable struct {
+	// TransportStreamId is the transport stream ID from the PAT
+	TransportStreamId uint16 `json:"transport_stream_id"`
+	// Version is the PAT version, or -1 if no PAT has been received yet
+	Version int `json:"version"`
+	// Programs is the list of programs, in PAT order
+	Programs []ProgramInfo `json:"programs"`
+}
+
+// ProgramInfo describes one program of a transport stream.
+type ProgramInfo struct {
+	// Number is the program number
+	Number uint16 `json:"number"`
+	// PmtPid is the PID that carries the program map table
+	PmtPid uint16 `json:"pmt_pid"`
+	// PcrPid is the PID that carries the program clock reference
+	PcrPid uint16 `json:"pcr_pid"`
+	// Version is the PMT version, or -1 if no PMT has been received yet
+	Version int `json:"version"`
+	// Streams is the list of elementary streams
+	Streams []ElementaryStream `json:"streams"`
+}
+
+// ElementaryStream describes one component of a program.
+type ElementaryStream struct {
+	// Pid is the PID that carries the stream
+	Pid uint16 `json:"pid"`
+	// Type is the stream type from the PMT
+	Type uint8 `json:"type"`
+	// Codec is a short name for the stream type, empty if unknown
+	Codec string `json:"codec,omitempty"`
+	// Kind is the type of content: video, audio, subtitles or data
+	Kind string `json:"kind"`
+	// Language is the ISO 639 language code, if there is one
+	Language string `json:"language,omitempty"`
+}
+
+// streamTypes maps PMT stream types to codec names.
+var streamTypes = map[uint8]string{
+	0x01: "mpeg1-video",
+	0x02: "mpeg2-video",
+	0x03: "mpeg1-audio",
+	0x04: "mpeg2-audio",
+	0x05: "private-sections",
+	0x0f: "aac",
+	0x10: "mpeg4-video",
+	0x11: "aac-latm",
+	0x15: "metadata",
+	0x1b: "h264",
+	0x24: "hevc",
+	0x81: "ac3",
+	0x86: "scte35",
+	0x87: "eac3",
+}
+
+// privateTypes maps descriptor tags to codec names, for private data streams (type 0x06).
+var privateTypes = map[uint8]string{
+	0x56: "teletext",
+	0x59: "dvb-subtitles",
+	0x6a: "ac3",
+	0x7a: "eac3",
+	0x7b: "dts",
+	0x7c: "aac",
+}
+
+// codecKinds maps codec names to the kind of content they carry.
+// Streams with other codecs are data.
+var codecKinds = map[string]string{
+	"mpeg1-video": "video",
+	"mpeg2-video": "video",
+	"mpeg4-video": "video",
+	"h264": "video",
+	"hevc": "video",
+	"mpeg1-audio": "audio",
+	"mpeg2-audio": "audio",
+	"aac": "audio",
+	"aac-latm": "audio",
+	"ac3": "audio",
+	"eac3": "audio",
+	"dts": "audio",
+	"teletext": "subtitles",
+	"dvb-subtitles": "subtitles",
+}
+
+// psi is a demultiplexer for the program specific information of a transport stream.
+//
+// It assembles the sections of the PAT and the PMTs it announces,
+// and keeps track of the programs and their elementary streams.
+// Packets are fed in from the streaming thread, while the table
+// can be queried concurrently.
+type psi struct {
+	// lock protects table
+	lock sync.RWMutex
+	// table is the current state of the program tables
+	table ProgramTable
+	// watch contains true for each PID that carries PSI we are interested in
+	watch [PidCount]bool
+	// buffers contains the partially received sections of each watched PID
+	buffers map[uint16]*sectionBuffer
+	// last contains the last accepted section of each PID, table ID extension
+	// and section number, so repeated sections are skipped without parsing.
+	// PMTs of several programs on a shared PID are kept apart by their program number.
+	last map[uint64][]byte
+	// generation is incremented each time the content of a table changes.
+	// It starts at 1, so the zero value means "never seen".
+	generation uint
+	// logger is the logger of the stream
+	logger JsonLogger
+}
+
+// sectionBuffer collects a PSI section that spans several packets.
+type sectionBuffer struct {
+	// data is the section data received so far
+	data []byte
+	// active is true while a section is being received
+	active bool
+}
+
+// newPsi creates a demultiplexer that reports table changes to logger.
+func newPsi(logger JsonLogger) *psi {
+	psi := &psi{
+		table: ProgramTable{
+			Version: -1,
+		},
+		buffers: make(map[uint16]*sectionBuffer),
+		last: make(map[uint64][]byte),
+		generation: 1,
+		logger: logger,
+	}
+	psi.watch[PatPid] = true
+	return psi
+}
+
+// Programs returns a snapshot of the program tables.
+func (psi *psi) Programs() ProgramTable {
+	psi.lock.RLock()
+	defer psi.lock.RUnlock()
+	table := psi.table
+	table.Programs = make([]ProgramInfo, len(psi.table.Programs))
+	for i, program := range psi.table.Programs {
+		program.Streams = make([]ElementaryStream, len(program.Streams))
+		copy(program.Streams, psi.table.Programs[i].Streams)
+		table.Programs[i] = program
+	}
+	return table
+}
+
+// expected calls visit for each PID that should be present in the stream,
+// according to the PAT and PMTs. table is true for PIDs carrying PSI.
+// Must be called from the goroutine that feeds the demultiplexer.
+func (psi *psi) expected(visit func(pid uint16, table bool)) {
+	visit(PatPid, true)
+	for _, program := range psi.table.Programs {
+		visit(program.PmtPid, true)
+		for _, stream := range program.Streams {
+			visit(stream.Pid, false)
+		}
+	}
+}
+
+// pmtSection returns the last program map section of a program,
+// or nil if it has not been received yet.
+// Must be called from the goroutine that feeds the demultiplexer.
+func (psi *psi) pmtSection(program ProgramInfo) []byte {
+	// sections are kept per program, so programs sharing a PID do not replace each other
+	section := psi.last[sectionKey(program.PmtPid, program.Number, 0)]
+	if len(section) < psiMinSection {
+		return nil
+	}
+	return section
+}
+
+// demux processes all packets of a batch.
+func (psi *psi) demux(batch *Batch) {
+	for _, packet := range batch.Packets {
+		if psi.watch[packet.Pid()] {
+			psi.process(packet)
+		}
+	}
+}
+
+// process adds a packet of a watched PID to its section buffer,
+// and parses the sections that are complete.
+func (psi *psi) process(packet Packet) {
+	pid := packet.Pid()
+	payload := packet.Payload()
+	if len(payload) == 0 {
+		return
+	}
+	buffer := psi.buffers[pid]
+	if buffer == nil {
+		buffer = &sectionBuffer{}
+		psi.buffers[pid] = buffer
+	}
+	if packet.PayloadStart() {
+		pointer := int(payload[0])
+		if 1 + pointer > len(payload) {
+			buffer.active = false
+			return
+		}
+		// the bytes before the pointer complete the previous section
+		if buffer.active {
+			buffer.data = append(buffer.data, payload[1:1 + pointer]...)
+			psi.sections(pid, buffer)
+		}
+		buffer.data = append(buffer.data[:0], payload[1 + pointer:]...)
+		buffer.active = true
+	} else if buffer.active {
+		buffer.data = append(buffer.data, payload...)
+	} else {
+		return
+	}
+	psi.sections(pid, buffer)
+}
+
+// sections parses the complete sections at the start of a buffer
+// and keeps the remainder.
+func (psi *psi) sections(pid uint16, buffer *sectionBuffer) {
+	data := buffer.data
+	for len(data) >= 3 {
+		if data[0] == 0xff {
+			// stuffing, the rest of the packet is empty
+			buffer.active = false
+			return
+		}
+		length := 3 + (int(data[1] & 0x0f) << 8 | int(data[2]))
+		if length > psiMaxSection {
+			// garbage, wait for the next section start
+			buffer.active = false
+			return
+		}
+		if len(data) < length {
+			break
+		}
+		psi.section(pid, data[:length])
+		data = data[length:]
+	}
+	if len(data) == 0 {
+		// the next section starts in a new packet
+		buffer.active = false
+	}
+	buffer.data = append(buffer.data[:0], data...)
+}
+
+// section verifies a complete section and updates the tables.
+func (psi *psi) section(pid uint16, section []byte) {
+	if len(section) < psiMinSection || section[1] & 0x80 == 0 {
+		return
+	}
+	// only apply tables that are currently valid
+	if section[5] & 0x01 == 0 {
+		return
+	}
+	key := sectionKey(pid, uint16(section[3]) << 8 | uint16(section[4]), section[6])
+	if bytes.Equal(psi.last[key], section) {
+		return
+	}
+	if crc32Mpeg(section) != 0 {
+		return
+	}
+	switch {
+		case pid == PatPid && section[0] == tableIdPat:
+			psi.pat(section)
+		case pid != PatPid && section[0] == tableIdPmt:
+			psi.pmt(pid, section)
+		default:
+			return
+	}
+	psi.last[key] = append(psi.last[key][:0], section...)
+}
+
+// sectionKey identifies a section by its PID, table ID extension and section number.
+// The table ID extension is the transport stream ID for the PAT
+// and the program number for PMTs.
+func sectionKey(pid uint16, extension uint16, number byte) uint64 {
+	return uint64(pid) << 24 | uint64(extension) << 8 | uint64(number)
+}
+
+// pat updates the program list from a program association section.
+func (psi *psi) pat(section []byte) {
+	tsid := uint16(section[3]) << 8 | uint16(section[4])
+	version := int(section[5] >> 1 & 0x1f)
+	single := section[7] == 0
+	
+	psi.lock.Lock()
+	previous := psi.table.Programs
+	changed := version != psi.table.Version
+	programs := make([]ProgramInfo, 0, (len(section) - psiMinSection) / 4)
+	if !single && version == psi.table.Version {
+		// other sections of the same table are still valid
+		programs = append(programs, previous...)
+	}
+	for pos := 8; pos + 4 <= len(section) - 4; pos += 4 {
+		number := uint16(section[pos]) << 8 | uint16(section[pos + 1])
+		pid := uint16(section[pos + 2] & 0x1f) << 8 | uint16(section[pos + 3])
+		if number == 0 {
+			// network information table
+			continue
+		}
+		program := ProgramInfo{
+			Number: number,
+			PmtPid: pid,
+			Version: -1,
+		}
+		// keep what we know about programs that did not change
+		for _, old := range previous {
+			if old.Number == number && old.PmtPid == pid {
+				program = old
+				break
+			}
+		}
+		replaced := false
+		for i := range programs {
+			if programs[i].Number == number {
+				programs[i] = program
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			programs = append(programs, program)
+		}
+	}
+	changed = changed || !samePrograms(previous, programs)
+	psi.table.TransportStreamId = tsid
+	psi.table.Version = version
+	psi.table.Programs = programs
+	psi.lock.Unlock()
+	
+	// repeated sections are skipped earlier, so the table did change
+	psi.generation++
+	psi.rewatch(programs)
+	
+	if !changed {
+		// same version and programs, nothing to report
+		return
+	}
+	psi.logger.Log(Dict{
+		"event": eventStreamerPat,
+		"tsid": tsid,
+		"version": version,
+		"programs": len(programs),
+		"message": fmt.Sprintf("Program association table version %d with %d programs", version, len(programs)),
+	})
+}
+
+// samePrograms returns true if two program lists announce the same programs on the same PIDs.
+func samePrograms(a []ProgramInfo, b []ProgramInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Number != b[i].Number || a[i].PmtPid != b[i].PmtPid {
+			return false
+		}
+	}
+	return true
+}
+
+// rewatch updates the set of watched PIDs after the program list has changed.
+// Buffers and sections of PIDs that are no longer watched are discarded.
+func (psi *psi) rewatch(programs []ProgramInfo) {
+	for pid := range psi.buffers {
+		psi.watch[pid] = false
+	}
+	psi.watch[PatPid] = true
+	for _, program := range programs {
+		psi.watch[program.PmtPid] = true
+	}
+	for pid := range psi.buffers {
+		if !psi.watch[pid] {
+			delete(psi.buffers, pid)
+		}
+	}
+	for key := range psi.last {
+		if !psi.watch[key >> 24] {
+			delete(psi.last, key)
+		}
+	}
+	// new programs need their PMT parsed, even if it was seen on the same PID before
+	for _, program := range programs {
+		if program.Version < 0 {
+			delete(psi.last, sectionKey(program.PmtPid, program.Number, 0))
+		}
+	}
+}
+
+// pmt updates the elementary streams of a program from a program map section.
+func (psi *psi) pmt(pid uint16, section []byte) {
+	number := uint16(section[3]) << 8 | uint16(section[4])
+	version := int(section[5] >> 1 & 0x1f)
+	pcr := uint16(section[8] & 0x1f) << 8 | uint16(section[9])
+	end := len(section) - 4
+	pos := 12 + (int(section[10] & 0x0f) << 8 | int(section[11]))
+	
+	var streams []ElementaryStream
+	for pos + 5 <= end {
+		info := int(section[pos + 3] & 0x0f) << 8 | int(section[pos + 4])
+		if pos + 5 + info > end {
+			break
+		}
+		stream := ElementaryStream{
+			Type: section[pos],
+			Pid: uint16(section[pos + 1] & 0x1f) << 8 | uint16(section[pos + 2]),
+			Codec: streamTypes[section[pos]],
+		}
+		describe(&stream, section[pos + 5:pos + 5 + info])
+		stream.Kind = codecKinds[stream.Codec]
+		if stream.Kind == "" {
+			stream.Kind = "data"
+		}
+		streams = append(streams, stream)
+		pos += 5 + info
+	}
+	
+	psi.lock.Lock()
+	found := false
+	changed := false
+	for i := range psi.table.Programs {
+		program := &psi.table.Programs[i]
+		if program.Number == number && program.PmtPid == pid {
+			changed = program.Version != version
+			program.PcrPid = pcr
+			program.Version = version
+			program.Streams = streams
+			found = true
+			break
+		}
+	}
+	psi.lock.Unlock()
+	if !found {
+		// not announced in the PAT
+		return
+	}
+	// the content can change without a new version, for example after a failover
+	psi.generation++
+	
+	if !changed {
+		return
+	}
+	psi.logger.Log(Dict{
+		"event": eventStreamerPmt,
+		"program": number,
+		"pid": pid,
+		"version": version,
+		"streams": len(streams),
+		"message": fmt.Sprintf("Program map table version %d for program %d with %d streams", version, number, len(streams)),
+	})
+}
+
+// describe fills in the codec of private data streams and the language
+// from the descriptors of an elementary stream.
+func describe(stream *ElementaryStream, descriptors []byte) {
+	for len(descriptors) >= 2 {
+		tag := descriptors[0]
+		length := int(descriptors[1])
+		if 2 + length > len(descriptors) {
+			return
+		}
+		body := descriptors[2:2 + length]
+		if stream.Type == 0x06 && stream.Codec == "" {
+			stream.Codec = privateTypes[tag]
+		}
+		switch tag {
+			// ISO 639 language, DVB subtitling and teletext descriptors start with a language code
+			case 0x0a, 0x56, 0x59:
+				if stream.Language == "" && len(body) >= 3 {
+					stream.Language = string(body[:3])
+				}
+		}
+		descriptors = descriptors[2 + length:]
+	}
+}
+
+// crc32MpegTable is the lookup table for crc32Mpeg.
+var crc32MpegTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc & 0x80000000 != 0 {
+				crc = crc << 1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32Mpeg calculates the CRC of PSI sections (CRC-32/MPEG-2).
+// Over a complete section including its CRC, the result is 0.
+func crc32Mpeg(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc << 8 ^ crc32MpegTable[byte(crc >> 24) ^ b]
+	}
+	return crc
+}
@@ -0,0 +1,113 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"testing"
+)
+
+// testSection builds a PSI section with a valid CRC.
+func testSection(table byte, extension uint16, version int, body []byte) []byte {
+	section := []byte{table, 0xb0, 0x00, byte(extension >> 8), byte(extension), 0xc1 | byte(version) << 1, 0x00, 0x00}
+	return sealSection(append(section, body...))
+}
+
+// testPacket builds a packet of a PID. If section is not nil, it is sent
+// as the payload, otherwise the payload is empty.
+func testPacket(pid uint16, section []byte) Packet {
+	packet := make(Packet, PacketSize)
+	packet[0] = SyncByte
+	packet[1] = byte(pid >> 8) & 0x1f
+	packet[2] = byte(pid)
+	packet[3] = 0x10
+	for i := 4; i < PacketSize; i++ {
+		packet[i] = 0xff
+	}
+	if section != nil {
+		packet[1] |= 0x40
+		packet[4] = 0x00
+		copy(packet[5:], section)
+	}
+	return packet
+}
+
+// testBatch puts packets into a batch.
+func testBatch(packets ...Packet) *Batch {
+	batch := NewBatch()
+	for _, packet := range packets {
+		batch.Append(packet)
+	}
+	return batch
+}
+
+// testPmt builds a PMT section for program 1 with a video stream on 0x101
+// and an audio stream on audio.
+func testPmt(version int, audio uint16) []byte {
+	body := []byte{
+		0xe1, 0x01, 0xf0, 0x00,
+		0x1b, 0xe1, 0x01, 0xf0, 0x00,
+		0x0f, 0xe0 | byte(audio >> 8), byte(audio), 0xf0, 0x00,
+	}
+	return testSection(tableIdPmt, 1, version, body)
+}
+
+// filteredPids returns the PIDs that a filter lets through for a batch.
+func filteredPids(filter *outputFilter, psi *psi, batch *Batch) map[uint16]bool {
+	pids := make(map[uint16]bool)
+	for _, output := range filter.apply(psi, batch) {
+		for _, packet := range output.Packets {
+			pids[packet.Pid()] = true
+		}
+		output.Release()
+	}
+	return pids
+}
+
+// TestPsiPmtContentChange checks that a PMT that changes without a new
+// version, as after an upstream failover, is applied to output filters.
+func TestPsiPmtContentChange(t *testing.T) {
+	psi := newPsi(&DummyLogger{})
+	pat := testSection(tableIdPat, 1, 0, []byte{0x00, 0x01, 0xe1, 0x00})
+	filter := newOutputFilter(OutputProfile{
+		Kinds: []string{"audio"},
+	})
+	media := func() *Batch {
+		return testBatch(testPacket(0x101, nil), testPacket(0x111, nil), testPacket(0x112, nil))
+	}
+	
+	psi.demux(testBatch(testPacket(PatPid, pat), testPacket(0x100, testPmt(3, 0x111))))
+	pids := filteredPids(filter, psi, media())
+	if !pids[0x111] || pids[0x112] {
+		t.Fatalf("before the change, got PIDs %v, want 0x111 and not 0x112", pids)
+	}
+	
+	// repetitions do not change anything
+	generation := psi.generation
+	psi.demux(testBatch(testPacket(PatPid, pat), testPacket(0x100, testPmt(3, 0x111))))
+	if psi.generation != generation {
+		t.Errorf("generation changed from %d to %d on a repetition", generation, psi.generation)
+	}
+	
+	psi.demux(testBatch(testPacket(PatPid, pat), testPacket(0x100, testPmt(3, 0x112))))
+	if psi.generation == generation {
+		t.Errorf("generation did not change with the PMT content")
+	}
+	pids = filteredPids(filter, psi, media())
+	if pids[0x111] || !pids[0x112] {
+		t.Errorf("after the change, got PIDs %v, want 0x112 and not 0x111", pids)
+	}
+}
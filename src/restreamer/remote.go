@@ -0,0 +1,182 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"io"
+	"fmt"
+	"net"
+	"time"
+	"context"
+	"net/url"
+	"net/http"
+)
+
+// RemoteState is a snapshot of the health of one upstream URL.
+// Timestamps are POSIX times in seconds, or 0 if the event never happened.
+type RemoteState struct {
+	// Url is the upstream URL
+	Url string `json:"url"`
+	// Address is the IP address of the upstream host, if host names are resolved
+	Address string `json:"address,omitempty"`
+	// Priority is the failover tier, lower values are preferred
+	Priority uint `json:"priority"`
+	// Connected is true while the remote is streaming
+	Connected bool `json:"connected"`
+	// Failures is the number of consecutive failed connection attempts
+	Failures uint `json:"failures"`
+	// LastError is the error message of the last failure
+	LastError string `json:"last_error,omitempty"`
+	// LastErrorType classifies the last failure, see the UpstreamReason constants
+	LastErrorType string `json:"last_error_type,omitempty"`
+	// LastFailure is the time of the last failure
+	LastFailure int64 `json:"last_failure"`
+	// LastConnect is the time when the remote last started streaming
+	LastConnect int64 `json:"last_connect"`
+	// NextAttempt is the earliest time for the next connection attempt
+	NextAttempt int64 `json:"next_attempt"`
+}
+
+// remote is an upstream URL along with its connection health.
+//
+// All fields are protected by the lock of the owning Client.
+type remote struct {
+	// url is the upstream URL
+	url *url.URL
+	// index is the position in the configured list, used to keep ordering stable
+	index int
+	// priority is the failover tier, lower values are preferred
+	priority uint
+	// weight is the relative share of connections within the tier.
+	// Resolved remotes keep the weight of their origin and share it.
+	weight uint
+	// credentials are the HTTP headers and authentication data
+	credentials Credentials
+	// command is the command line for exec remotes
+	command []string
+	// binding is the local address and interface for connections and multicast joins
+	binding Binding
+	// origin is the configured remote that this one was resolved from,
+	// nil if it is a configured remote itself
+	origin *remote
+	// address is the IP address that the host name of url resolved to.
+	// Connections to the host are made to this address instead.
+	address string
+	// connector is the network dialer for TCP sockets, bound to binding
+	connector *net.Dialer
+	// transport is the HTTP transport used by getter
+	transport *http.Transport
+	// getter is the HTTP client for this remote
+	getter *http.Client
+	// connected is true while the remote is streaming
+	connected bool
+	// failures is the number of consecutive failed connection attempts
+	failures uint
+	// lastError is the last error that occured on this remote
+	lastError string
+	// lastErrorType is the classification of lastError
+	lastErrorType string
+	// lastFailure is the time of the last failure
+	lastFailure time.Time
+	// lastConnect is the time when the remote last started streaming
+	lastConnect time.Time
+	// next is the earliest time for the next connection attempt
+	next time.Time
+}
+
+// configured returns the configured remote that this one was resolved from,
+// or the remote itself if it was configured.
+func (remote *remote) configured() *remote {
+	if remote.origin != nil {
+		return remote.origin
+	}
+	return remote
+}
+
+// state returns a snapshot of the remote's health.
+func (remote *remote) state() RemoteState {
+	state := RemoteState{
+		Url: remote.url.String(),
+		Address: remote.address,
+		Priority: remote.priority,
+		Connected: remote.connected,
+		Failures: remote.failures,
+		LastError: remote.lastError,
+		LastErrorType: remote.lastErrorType,
+	}
+	if !remote.lastFailure.IsZero() {
+		state.LastFailure = remote.lastFailure.Unix()
+	}
+	if !remote.lastConnect.IsZero() {
+		state.LastConnect = remote.lastConnect.Unix()
+	}
+	if !remote.next.IsZero() {
+		state.NextAttempt = remote.next.Unix()
+	}
+	return state
+}
+
+// String returns the URL of the remote, followed by the resolved address.
+func (remote *remote) String() string {
+	if remote.address != "" {
+		return fmt.Sprintf("%s (%s)", remote.url, remote.address)
+	}
+	return remote.url.String()
+}
+
+// dial connects to an address with the dialer of the remote.
+// If the host is the one of the remote URL and it has been resolved,
+// the resolved address is used instead. Other hosts, for example
+// after an HTTP redirect, are dialed as they are.
+func (remote *remote) dial(network, address string) (net.Conn, error) {
+	return remote.dialContext(context.Background(), network, address)
+}
+
+// dialContext is like dial, but the connection attempt is aborted when ctx is done.
+func (remote *remote) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if remote.address != "" {
+		host, port, err := net.SplitHostPort(address)
+		if err == nil && host == remote.url.Hostname() {
+			address = net.JoinHostPort(remote.address, port)
+		}
+	}
+	return remote.connector.DialContext(ctx, network, address)
+}
+
+// better returns true if remote should be tried before other,
+// when none of them can be connected right away.
+// The remote that becomes available first wins, then the one with
+// the better priority, and then the configured order.
+func (remote *remote) better(other *remote) bool {
+	if !remote.next.Equal(other.next) {
+		return remote.next.Before(other.next)
+	}
+	if remote.priority != other.priority {
+		return remote.priority < other.priority
+	}
+	return remote.index < other.index
+}
+
+// connection is an opened upstream that is not streaming yet.
+type connection struct {
+	// remote is the upstream the connection belongs to
+	remote *remote
+	// input is the input stream
+	input io.ReadCloser
+	// response is the HTTP response, if the upstream is an HTTP server
+	response *http.Response
+}
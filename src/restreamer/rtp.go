@@ -0,0 +1,250 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// RtpDefaultWindow is the default size of the reordering window, in datagrams.
+	RtpDefaultWindow = 32
+	// rtpHeaderSize is the size of the fixed RTP header
+	rtpHeaderSize = 12
+	// rtpVersion is the only supported RTP version
+	rtpVersion = 2
+	// rtpResyncThreshold is the sequence number jump that is considered
+	// a sender restart rather than packet loss.
+	rtpResyncThreshold = 1000
+)
+
+// rtpSlot holds one datagram payload in the reordering window.
+type rtpSlot struct {
+	// valid is true if the slot contains a datagram that was not delivered yet
+	valid bool
+	// lost is true if the datagram was skipped without having arrived
+	lost bool
+	// sequence is the RTP sequence number of the datagram
+	sequence uint16
+	// payload is the datagram payload, without RTP header and padding
+	payload []byte
+}
+
+// RtpReader receives RTP datagrams from a socket and returns the
+// encapsulated payload (normally TS packets) as a continuous stream.
+//
+// Datagrams are put back into sequence order within a small window.
+// Missing datagrams are skipped once the window is full, and each of
+// them is reported as lost to the stats collector. Duplicates and
+// datagrams that arrive after their slot was skipped are discarded,
+// but only duplicates are reported.
+type RtpReader struct {
+	// conn is the datagram socket
+	conn net.Conn
+	// stats receives loss and duplicate notifications
+	stats Collector
+	// datagram is the receive buffer
+	datagram []byte
+	// slots is the reordering window, indexed by sequence number modulo window size
+	slots []rtpSlot
+	// started is false until the first datagram has been received
+	started bool
+	// expected is the next sequence number to be delivered
+	expected uint16
+	// output contains payload data that is ready to be read
+	output []byte
+	// offset is the read position in output
+	offset int
+}
+
+// NewRtpReader creates an RTP depacketizer on top of a datagram socket.
+// window is the number of datagrams that can be held back for reordering,
+// 0 selects the default. It is rounded up to the next power of two,
+// so sequence number wraparound maps cleanly onto the window slots.
+func NewRtpReader(conn net.Conn, window int, stats Collector) *RtpReader {
+	if window <= 0 {
+		window = RtpDefaultWindow
+	}
+	size := 1
+	for size < window {
+		size <<= 1
+	}
+	return &RtpReader{
+		conn: conn,
+		stats: stats,
+		datagram: make([]byte, udpDatagramSize),
+		slots: make([]rtpSlot, size),
+	}
+}
+
+// SetCollector assigns a stats collector
+func (reader *RtpReader) SetCollector(stats Collector) {
+	reader.stats = stats
+}
+
+// Read returns depacketized data, receiving more datagrams as needed.
+func (reader *RtpReader) Read(data []byte) (int, error) {
+	for reader.offset >= len(reader.output) {
+		reader.output = reader.output[:0]
+		reader.offset = 0
+		length, err := reader.conn.Read(reader.datagram)
+		if err != nil {
+			return 0, err
+		}
+		reader.receive(reader.datagram[:length])
+	}
+	count := copy(data, reader.output[reader.offset:])
+	reader.offset += count
+	return count, nil
+}
+
+// Close closes the underlying socket.
+func (reader *RtpReader) Close() error {
+	return reader.conn.Close()
+}
+
+// SetReadDeadline sets the read deadline of the underlying socket.
+func (reader *RtpReader) SetReadDeadline(deadline time.Time) error {
+	return reader.conn.SetReadDeadline(deadline)
+}
+
+// receive parses a datagram and puts it into the reordering window.
+// Datagrams that are now in sequence are appended to the output buffer.
+func (reader *RtpReader) receive(datagram []byte) {
+	sequence, payload, ok := parseRtp(datagram)
+	if !ok {
+		return
+	}
+	
+	if !reader.started {
+		reader.started = true
+		reader.expected = sequence
+	}
+	
+	window := len(reader.slots)
+	distance := int(int16(sequence - reader.expected))
+	
+	if distance >= rtpResyncThreshold || distance < -rtpResyncThreshold {
+		// the sender was restarted or jumped; deliver what we have and start over
+		reader.flush()
+		reader.expected = sequence
+	}
+	for int(int16(sequence - reader.expected)) >= window {
+		// not enough room, give up waiting for the oldest datagram
+		reader.skip()
+	}
+	slot := &reader.slots[int(sequence) % window]
+	if int16(sequence - reader.expected) < 0 {
+		// we already delivered or skipped this one
+		if slot.sequence == sequence && !slot.valid {
+			if slot.lost {
+				// late, it was already reported as lost
+				slot.lost = false
+			} else {
+				reader.stats.DatagramDuplicated()
+			}
+		}
+		// otherwise it is too old to tell
+		return
+	}
+	
+	if slot.valid && slot.sequence == sequence {
+		reader.stats.DatagramDuplicated()
+		return
+	}
+	slot.valid = true
+	slot.lost = false
+	slot.sequence = sequence
+	slot.payload = append(slot.payload[:0], payload...)
+	
+	// hand out everything that is in order now
+	reader.deliver()
+}
+
+// deliver appends consecutive datagrams starting at the expected sequence number
+// to the output buffer.
+func (reader *RtpReader) deliver() {
+	window := len(reader.slots)
+	for {
+		slot := &reader.slots[int(reader.expected) % window]
+		if !slot.valid || slot.sequence != reader.expected {
+			return
+		}
+		reader.output = append(reader.output, slot.payload...)
+		slot.valid = false
+		reader.expected++
+	}
+}
+
+// skip advances the expected sequence number by one, delivering the
+// datagram in that slot or reporting it as lost if it never arrived.
+func (reader *RtpReader) skip() {
+	slot := &reader.slots[int(reader.expected) % len(reader.slots)]
+	if slot.valid && slot.sequence == reader.expected {
+		reader.output = append(reader.output, slot.payload...)
+		slot.valid = false
+	} else {
+		slot.valid = false
+		slot.lost = true
+		slot.sequence = reader.expected
+		reader.stats.DatagramLost()
+	}
+	reader.expected++
+	reader.deliver()
+}
+
+// flush delivers all datagrams in the window in sequence order,
+// without reporting losses, and empties the window.
+func (reader *RtpReader) flush() {
+	for range reader.slots {
+		slot := &reader.slots[int(reader.expected) % len(reader.slots)]
+		if slot.valid && slot.sequence == reader.expected {
+			reader.output = append(reader.output, slot.payload...)
+		}
+		slot.valid = false
+		slot.lost = false
+		reader.expected++
+	}
+}
+
+// parseRtp validates an RTP header and returns the sequence number and payload.
+// ok is false if the datagram is not a valid RTP packet.
+func parseRtp(datagram []byte) (sequence uint16, payload []byte, ok bool) {
+	if len(datagram) < rtpHeaderSize || datagram[0] >> 6 != rtpVersion {
+		return 0, nil, false
+	}
+	sequence = uint16(datagram[2]) << 8 | uint16(datagram[3])
+	end := len(datagram)
+	// padding: the last byte contains the number of padding bytes
+	if datagram[0] & 0x20 != 0 {
+		end -= int(datagram[end - 1])
+	}
+	// fixed header and CSRC list
+	start := rtpHeaderSize + 4 * int(datagram[0] & 0x0f)
+	// header extension: 16 bit profile, 16 bit length in 32-bit words
+	if datagram[0] & 0x10 != 0 {
+		if start + 4 > end {
+			return 0, nil, false
+		}
+		start += 4 + 4 * (int(datagram[start + 2]) << 8 | int(datagram[start + 3]))
+	}
+	if start > end {
+		return 0, nil, false
+	}
+	return sequence, datagram[start:end], true
+}
@@ -22,6 +22,12 @@ import (
 	"sync/atomic"
 )
 
+const (
+	// statisticsPcrExpiry is the time after which a PCR measurement
+	// is no longer reported, because the stream stopped delivering PCRs
+	statisticsPcrExpiry = 3 * time.Second
+)
+
 // Collector is the public face of a statistics collector.
 // It is implemented by the individual stream stats.
 type Collector interface {
@@ -29,15 +35,34 @@ type Collector interface {
 	ConnectionAdded()
 	// ConnectionRemoved notifies that a downstream client disconnected.
 	ConnectionRemoved()
-	// PacketReceived notifies that a packet was received.
+	// PacketsReceived notifies that a number of packets were received.
 	// TODO pass the endpoint here
-	PacketReceived()
-	// PacketReceived notifies that a packet was sent.
+	PacketsReceived(count int)
+	// PacketsSent notifies that a number of packets were sent.
 	// TODO pass the endpoint here
-	PacketSent()
-	// PacketReceived notifies that a packet was dropped.
+	PacketsSent(count int)
+	// PacketsDropped notifies that a number of packets were dropped.
 	// TODO pass the endpoint here
-	PacketDropped()
+	PacketsDropped(count int)
+	// DatagramLost notifies that an upstream datagram went missing.
+	DatagramLost()
+	// DatagramDuplicated notifies that a duplicate or late upstream datagram was discarded.
+	DatagramDuplicated()
+	// SyncLost notifies that the upstream lost TS packet sync.
+	SyncLost()
+	// ContinuityError notifies that the continuity counter of a PID was wrong,
+	// meaning that packets were lost or reordered.
+	ContinuityError(pid uint16)
+	// TransportError notifies that a packet with the transport error indicator was received.
+	TransportError(pid uint16)
+	// PacketsScrambled notifies that a number of scrambled packets were received.
+	PacketsScrambled(pid uint16, count int)
+	// PidTimeout notifies that an expected PID has not been received for too long.
+	PidTimeout(pid uint16)
+	// PcrError notifies that the interval between two PCRs on a PID was too long.
+	PcrError(pid uint16)
+	// PcrMeasured notifies that the timing of the stream has been measured.
+	PcrMeasured(measurement PcrStatistics)
 	// SourceConnected notifies that upstream is live.
 	SourceConnected()
 	// SourceDisconnected notifies that upstream is offline.
@@ -58,8 +83,22 @@ type realCollector struct {
 	packetsSent uint64
 	// total number of dropped packets
 	packetsDropped uint64
+	// total number of lost upstream datagrams
+	datagramsLost uint64
+	// total number of discarded duplicate upstream datagrams
+	datagramsDuplicated uint64
+	// total number of upstream sync losses
+	syncLosses uint64
 	// upstream connection state, 0 = offline, !0 = connected
 	connected int32
+	// lock protects pids, pcr and measured
+	lock sync.Mutex
+	// error counters of each PID that had errors
+	pids map[uint16]*PidStatistics
+	// the last PCR measurement
+	pcr PcrStatistics
+	// the time of the last PCR measurement
+	measured time.Time
 }
 
 func (stats *realCollector) ConnectionAdded() {
@@ -70,16 +109,101 @@ func (stats *realCollector) ConnectionRemoved() {
 	atomic.AddInt64(&stats.connections, -1)
 }
 
-func (stats *realCollector) PacketReceived() {
-	atomic.AddUint64(&stats.packetsReceived, 1)
+func (stats *realCollector) PacketsReceived(count int) {
+	atomic.AddUint64(&stats.packetsReceived, uint64(count))
+}
+
+func (stats *realCollector) PacketsSent(count int) {
+	atomic.AddUint64(&stats.packetsSent, uint64(count))
+}
+
+func (stats *realCollector) PacketsDropped(count int) {
+	atomic.AddUint64(&stats.packetsDropped, uint64(count))
+}
+
+func (stats *realCollector) DatagramLost() {
+	atomic.AddUint64(&stats.datagramsLost, 1)
+}
+
+func (stats *realCollector) DatagramDuplicated() {
+	atomic.AddUint64(&stats.datagramsDuplicated, 1)
+}
+
+func (stats *realCollector) SyncLost() {
+	atomic.AddUint64(&stats.syncLosses, 1)
+}
+
+func (stats *realCollector) ContinuityError(pid uint16) {
+	stats.lock.Lock()
+	stats.pid(pid).ContinuityErrors++
+	stats.lock.Unlock()
+}
+
+func (stats *realCollector) TransportError(pid uint16) {
+	stats.lock.Lock()
+	stats.pid(pid).TransportErrors++
+	stats.lock.Unlock()
 }
 
-func (stats *realCollector) PacketSent() {
-	atomic.AddUint64(&stats.packetsSent, 1)
+func (stats *realCollector) PacketsScrambled(pid uint16, count int) {
+	stats.lock.Lock()
+	stats.pid(pid).ScrambledPackets += uint64(count)
+	stats.lock.Unlock()
 }
 
-func (stats *realCollector) PacketDropped() {
-	atomic.AddUint64(&stats.packetsDropped, 1)
+func (stats *realCollector) PidTimeout(pid uint16) {
+	stats.lock.Lock()
+	stats.pid(pid).Timeouts++
+	stats.lock.Unlock()
+}
+
+func (stats *realCollector) PcrError(pid uint16) {
+	stats.lock.Lock()
+	stats.pid(pid).PcrErrors++
+	stats.lock.Unlock()
+}
+
+// pid returns the error counters of a PID, creating them if necessary.
+// Must be called with the lock held.
+func (stats *realCollector) pid(pid uint16) *PidStatistics {
+	counters := stats.pids[pid]
+	if counters == nil {
+		if stats.pids == nil {
+			stats.pids = make(map[uint16]*PidStatistics)
+		}
+		counters = &PidStatistics{}
+		stats.pids[pid] = counters
+	}
+	return counters
+}
+
+// pidStatistics returns a copy of the error counters of all PIDs.
+func (stats *realCollector) pidStatistics() map[uint16]PidStatistics {
+	stats.lock.Lock()
+	pids := make(map[uint16]PidStatistics, len(stats.pids))
+	for pid, counters := range stats.pids {
+		pids[pid] = *counters
+	}
+	stats.lock.Unlock()
+	return pids
+}
+
+func (stats *realCollector) PcrMeasured(measurement PcrStatistics) {
+	stats.lock.Lock()
+	stats.pcr = measurement
+	stats.measured = time.Now()
+	stats.lock.Unlock()
+}
+
+// pcrStatistics returns the last PCR measurement,
+// or an empty one if there has been none for a while.
+func (stats *realCollector) pcrStatistics() PcrStatistics {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	if time.Since(stats.measured) > statisticsPcrExpiry {
+		return PcrStatistics{}
+	}
+	return stats.pcr
 }
 
 func (stats *realCollector) SourceConnected() {
@@ -102,6 +226,9 @@ func (stats *realCollector) clone() *realCollector {
 		packetsReceived: atomic.LoadUint64(&stats.packetsReceived),
 		packetsSent: atomic.LoadUint64(&stats.packetsSent),
 		packetsDropped: atomic.LoadUint64(&stats.packetsDropped),
+		datagramsLost: atomic.LoadUint64(&stats.datagramsLost),
+		datagramsDuplicated: atomic.LoadUint64(&stats.datagramsDuplicated),
+		syncLosses: atomic.LoadUint64(&stats.syncLosses),
 		connected: atomic.LoadInt32(&stats.connected),
 	}
 }
@@ -124,11 +251,32 @@ func (from *realCollector) invsub(to *realCollector) {
 	from.packetsReceived = to.packetsReceived - from.packetsReceived
 	from.packetsSent= to.packetsSent - from.packetsSent
 	from.packetsDropped= to.packetsDropped - from.packetsDropped
+	from.datagramsLost = to.datagramsLost - from.datagramsLost
+	from.datagramsDuplicated = to.datagramsDuplicated - from.datagramsDuplicated
+	from.syncLosses = to.syncLosses - from.syncLosses
 	from.connected = to.connected
 }
 
+// PidStatistics are the error counters of a single PID.
+type PidStatistics struct {
+	// ContinuityErrors is the number of continuity counter errors
+	ContinuityErrors uint64 `json:"continuity_errors"`
+	// TransportErrors is the number of packets with the transport error indicator
+	TransportErrors uint64 `json:"transport_errors"`
+	// ScrambledPackets is the number of scrambled packets
+	ScrambledPackets uint64 `json:"scrambled_packets"`
+	// Timeouts is the number of times the PID was missing for too long
+	Timeouts uint64 `json:"timeouts"`
+	// PcrErrors is the number of PCR intervals longer than 40ms
+	PcrErrors uint64 `json:"pcr_errors"`
+}
+
 // StreamStatistics is the current state of a single stream
 // or all streams combined.
+//
+// Pids contains the error counters of each PID that had errors.
+// It is only set for single streams. The map is replaced on each
+// update and must not be modified.
 type StreamStatistics struct {
 	Connections int64
 	MaxConnections int64
@@ -144,6 +292,16 @@ type StreamStatistics struct {
 	BytesPerSecondReceived uint64
 	BytesPerSecondSent uint64
 	BytesPerSecondDropped uint64
+	TotalDatagramsLost uint64
+	TotalDatagramsDuplicated uint64
+	TotalSyncLosses uint64
+	TotalContinuityErrors uint64
+	TotalTransportErrors uint64
+	TotalScrambledPackets uint64
+	TotalPidTimeouts uint64
+	TotalPcrErrors uint64
+	Pids map[uint16]PidStatistics
+	Pcr PcrStatistics
 	Connected bool
 }
 
@@ -218,6 +376,14 @@ func (stats *realStatistics) update(delta time.Duration, change map[string]*real
 	stats.global.BytesPerSecondReceived = 0
 	stats.global.BytesPerSecondSent = 0
 	stats.global.BytesPerSecondDropped = 0
+	stats.global.TotalDatagramsLost = 0
+	stats.global.TotalDatagramsDuplicated = 0
+	stats.global.TotalSyncLosses = 0
+	stats.global.TotalContinuityErrors = 0
+	stats.global.TotalTransportErrors = 0
+	stats.global.TotalScrambledPackets = 0
+	stats.global.TotalPidTimeouts = 0
+	stats.global.TotalPcrErrors = 0
 	stats.global.Connected = false
 	
 	// loop over all streams
@@ -238,8 +404,27 @@ func (stats *realStatistics) update(delta time.Duration, change map[string]*real
 		stream.BytesPerSecondReceived = stream.PacketsPerSecondReceived * PacketSize
 		stream.BytesPerSecondSent = stream.PacketsPerSecondSent * PacketSize
 		stream.BytesPerSecondDropped = stream.PacketsPerSecondDropped * PacketSize
+		stream.TotalDatagramsLost += diff.datagramsLost
+		stream.TotalDatagramsDuplicated += diff.datagramsDuplicated
+		stream.TotalSyncLosses += diff.syncLosses
 		stream.Connected = diff.connected != 0
 		
+		// the PID counters are totals already, the PCR measurement is a gauge
+		stream.Pids = stats.internal[name].pidStatistics()
+		stream.Pcr = stats.internal[name].pcrStatistics()
+		stream.TotalContinuityErrors = 0
+		stream.TotalTransportErrors = 0
+		stream.TotalScrambledPackets = 0
+		stream.TotalPidTimeouts = 0
+		stream.TotalPcrErrors = 0
+		for _, counters := range stream.Pids {
+			stream.TotalContinuityErrors += counters.ContinuityErrors
+			stream.TotalTransportErrors += counters.TransportErrors
+			stream.TotalScrambledPackets += counters.ScrambledPackets
+			stream.TotalPidTimeouts += counters.Timeouts
+			stream.TotalPcrErrors += counters.PcrErrors
+		}
+		
 		// update the global counters as well
 		stats.global.Connections += stream.Connections
 		stats.global.TotalPacketsReceived += stream.TotalPacketsReceived
@@ -254,6 +439,14 @@ func (stats *realStatistics) update(delta time.Duration, change map[string]*real
 		stats.global.BytesPerSecondReceived += stream.BytesPerSecondReceived
 		stats.global.BytesPerSecondSent += stream.BytesPerSecondSent
 		stats.global.BytesPerSecondDropped += stream.BytesPerSecondDropped
+		stats.global.TotalDatagramsLost += stream.TotalDatagramsLost
+		stats.global.TotalDatagramsDuplicated += stream.TotalDatagramsDuplicated
+		stats.global.TotalSyncLosses += stream.TotalSyncLosses
+		stats.global.TotalContinuityErrors += stream.TotalContinuityErrors
+		stats.global.TotalTransportErrors += stream.TotalTransportErrors
+		stats.global.TotalScrambledPackets += stream.TotalScrambledPackets
+		stats.global.TotalPidTimeouts += stream.TotalPidTimeouts
+		stats.global.TotalPcrErrors += stream.TotalPcrErrors
 		if stream.Connected {
 			stats.global.Connected = true
 		}
@@ -418,13 +611,40 @@ func (stats *DummyCollector) ConnectionAdded() {
 func (stats *DummyCollector) ConnectionRemoved() {
 }
 
-func (stats *DummyCollector) PacketReceived() {
+func (stats *DummyCollector) PacketsReceived(count int) {
+}
+
+func (stats *DummyCollector) PacketsSent(count int) {
+}
+
+func (stats *DummyCollector) PacketsDropped(count int) {
+}
+
+func (stats *DummyCollector) DatagramLost() {
+}
+
+func (stats *DummyCollector) DatagramDuplicated() {
+}
+
+func (stats *DummyCollector) SyncLost() {
+}
+
+func (stats *DummyCollector) ContinuityError(pid uint16) {
+}
+
+func (stats *DummyCollector) TransportError(pid uint16) {
+}
+
+func (stats *DummyCollector) PacketsScrambled(pid uint16, count int) {
+}
+
+func (stats *DummyCollector) PidTimeout(pid uint16) {
 }
 
-func (stats *DummyCollector) PacketSent() {
+func (stats *DummyCollector) PcrError(pid uint16) {
 }
 
-func (stats *DummyCollector) PacketDropped() {
+func (stats *DummyCollector) PcrMeasured(measurement PcrStatistics) {
 }
 
 func (stats *DummyCollector) SourceConnected() {
@@ -19,6 +19,8 @@ package restreamer
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 	"errors"
 	"net/http"
 )
@@ -34,10 +36,23 @@ const (
 	eventStreamerClientRemove = "remove"
 	eventStreamerStreaming = "streaming"
 	eventStreamerClosed = "closed"
+	eventStreamerOnline = "online"
+	eventStreamerOffline = "offline"
+	eventStreamerExpired = "expired"
+	eventStreamerFallback = "fallback"
+	eventStreamerResume = "resume"
+	eventStreamerDemand = "demand"
+	eventStreamerIdle = "idle"
+	eventStreamerPat = "pat"
+	eventStreamerPmt = "pmt"
+	eventStreamerPidTimeout = "pidtimeout"
 	//
 	errorStreamerInvalidCommand = "invalidcmd"
 	errorStreamerPoolFull = "poolfull"
 	errorStreamerOffline = "offline"
+	errorStreamerDemandTimeout = "demandtimeout"
+	errorStreamerProfile = "profile"
+	errorStreamerFallback = "fallback"
 )
 
 var (
@@ -67,6 +82,9 @@ const (
 	StreamerCommandAdd
 	// StreamerCommandRemove signals a stream to remove a connection.
 	StreamerCommandRemove
+	// streamerCommandFallback signals that the upstream is gone
+	// and the fallback should be played.
+	streamerCommandFallback
 )
 
 // ConnectionRequest encapsulates a request that new connection be added or removed.
@@ -79,18 +97,66 @@ type ConnectionRequest struct {
 	Connection *Connection
 }
 
+// DemandListener is notified when a stream gets its first viewer
+// and when the last viewer has left.
+// It is used to connect upstreams only while they are needed.
+//
+// The methods are called with the streamer lock held, so they must not block.
+type DemandListener interface {
+	// Demand is called when a viewer arrives on a stream without viewers.
+	Demand()
+	// Idle is called when the last viewer has left.
+	Idle()
+}
+
 // Streamer implements a TS packet multiplier,
 // distributing received packets on the input queue to the output queues.
 // It also handles and manages HTTP connections when added to an HTTP server.
+//
+// The streamer is notified of upstream state changes through the
+// ConnectCloser interface. When the upstream goes away, connected clients
+// are kept for the Grace period, so they survive a reconnect or failover.
+// They are only dropped when the upstream does not come back in time.
+//
+// If a fallback is set, it is played while the upstream is offline instead,
+// and clients are never dropped.
+//
+// If a demand listener is set, it is notified when the first viewer arrives,
+// and the viewer is held until the upstream is online or DemandTimeout expires.
 type Streamer struct {
-	// input is the input queue, accepting packets.
+	// input is the input queue, accepting packet batches.
 	// When closed, streamer is stopped and all outgoing queues along with it.
-	input <-chan Packet
-	// lock is the outgoing connection pool lock
+	input <-chan *Batch
+	// lock protects manager, grace, ready, viewers and filters,
+	// and serializes changes to extractions
 	lock sync.Mutex
+	// manager notifies all connected clients when the grace period has expired
+	manager *StateManager
+	// grace is the timer that runs while the upstream is offline
+	grace *time.Timer
+	// Grace is the time that clients are kept connected after the upstream went offline.
+	// If it is 0, clients are dropped immediately.
+	Grace time.Duration
+	// online is true while the upstream is connected or within the grace period.
+	// Incoming connections are only allowed while online, or if there is a fallback.
+	online AtomicBool
+	// reconnected is set when the upstream connects or disconnects,
+	// so the monitor starts over with the next batch
+	reconnected AtomicBool
+	// fallback is played while the upstream is offline, may be nil
+	fallback *Fallback
+	// ready is closed when the upstream comes online
+	ready chan struct{}
+	// demand is notified when the first viewer arrives and the last one leaves, may be nil
+	demand DemandListener
+	// viewers is the number of viewers, including those waiting for the upstream
+	viewers int
+	// DemandTimeout is the time that a viewer is held while the upstream is connecting
+	// on demand. If it is 0, viewers wait until the upstream is online.
+	DemandTimeout time.Duration
 	// broker is a global connection broker
 	broker ConnectionBroker
-	// queueSize defines the maximum number of packets to queue per outgoing connection
+	// queueSize defines the maximum number of batches to queue per outgoing connection
 	queueSize int
 	// running reflects the state of the stream: if true, the Stream thread is running and
 	// incoming connections are allowed.
@@ -100,10 +166,36 @@ type Streamer struct {
 	stats Collector
 	// logger is a json logger
 	logger *ModuleLogger
+	// psi tracks the programs of the upstream
+	psi *psi
+	// monitor checks the integrity of the upstream
+	monitor *monitor
+	// PidTimeout is the time after which an elementary stream that is
+	// announced in a PMT, but not received, is reported as missing.
+	// Must be set before Stream().
+	PidTimeout time.Duration
+	// profiles are the named output profiles that clients can select with ?profile=
+	profiles map[string]OutputProfile
+	// filters are the output filters in use, by profile key
+	filters map[string]*outputFilter
+	// extractions contains the programs that are extracted into other streamers,
+	// as an []*extraction. It is replaced on each change, so the streaming
+	// goroutine can read it without taking the lock.
+	extractions atomic.Value
 	// request is an unbuffered queue for requests to add or remove a connection
 	request chan ConnectionRequest
 }
 
+// extraction feeds a program of a stream into another streamer.
+type extraction struct {
+	// filter selects the program
+	filter *outputFilter
+	// child is the streamer that serves the program
+	child *Streamer
+	// queue is the input queue of the child
+	queue chan *Batch
+}
+
 // ConnectionBroker represents a policy handler for new connections.
 // It is used to determine if new connections can be accepted,
 // based on arbitrary rules.
@@ -118,7 +210,7 @@ type ConnectionBroker interface {
 
 // NewStreamer creates a new packet streamer.
 // queue is an input packet queue.
-// qsize is the length of each connection's queue (in packets).
+// qsize is the length of each connection's queue (in packets, converted to batches).
 // broker handles policy enforcement
 // stats is a statistics collector object.
 func NewStreamer(qsize uint, broker ConnectionBroker) (*Streamer) {
@@ -129,12 +221,21 @@ func NewStreamer(qsize uint, broker ConnectionBroker) (*Streamer) {
 		},
 		AddTimestamp: true,
 	}
+	psi := newPsi(logger)
 	streamer := &Streamer{
 		broker: broker,
-		queueSize: int(qsize),
+		queueSize: BatchQueueSize(qsize),
+		manager: NewStateManager(),
+		Grace: 0,
+		ready: make(chan struct{}),
+		online: AtomicFalse,
 		running: AtomicFalse,
 		stats: &DummyCollector{},
 		logger: logger,
+		psi: psi,
+		monitor: newMonitor(psi, logger),
+		PidTimeout: MonitorDefaultPidTimeout,
+		filters: make(map[string]*outputFilter),
 		request: make(chan ConnectionRequest),
 	}
 	// start the command eater
@@ -147,9 +248,191 @@ func (streamer *Streamer) SetLogger(logger JsonLogger) {
 	streamer.logger.Logger = logger
 }
 
+// Programs returns the programs that the upstream carries, as announced
+// by its PAT and PMTs. The fallback is not included.
+func (streamer *Streamer) Programs() ProgramTable {
+	return streamer.psi.Programs()
+}
+
 // SetCollector assigns a stats collector
 func (streamer *Streamer) SetCollector(stats Collector) {
 	streamer.stats = stats
+	streamer.monitor.stats = stats
+}
+
+// SetFallback assigns a file that is played while the upstream is offline.
+// Must be called before Stream().
+func (streamer *Streamer) SetFallback(fallback *Fallback) {
+	streamer.fallback = fallback
+}
+
+// SetProfiles assigns the named output profiles.
+// Clients select a profile with ?profile=name, or build their own
+// with ?programs=, ?pids=, ?kinds= and ?languages=.
+func (streamer *Streamer) SetProfiles(profiles map[string]OutputProfile) {
+	streamer.profiles = profiles
+}
+
+// SetDemandListener assigns a listener that is notified when viewers
+// arrive on an idle stream, and when the last viewer has left.
+// Must be called before the stream is served.
+func (streamer *Streamer) SetDemandListener(listener DemandListener) {
+	streamer.demand = listener
+}
+
+// Connect signals that the upstream is connected, ending the grace period.
+// Satisfies the ConnectCloser interface.
+func (streamer *Streamer) Connect() error {
+	for _, extraction := range streamer.extracted() {
+		extraction.child.Connect()
+	}
+	StoreBool(&streamer.reconnected, true)
+	
+	streamer.lock.Lock()
+	defer streamer.lock.Unlock()
+	
+	if streamer.grace != nil {
+		streamer.grace.Stop()
+		streamer.grace = nil
+		streamer.logger.Log(Dict{
+			"event": eventStreamerOnline,
+			"message": "Upstream reconnected within the grace period",
+		})
+	} else if !LoadBool(&streamer.online) {
+		StoreBool(&streamer.online, true)
+		close(streamer.ready)
+		streamer.logger.Log(Dict{
+			"event": eventStreamerOnline,
+			"message": "Upstream connected, accepting clients",
+		})
+	}
+	return nil
+}
+
+// Close signals that the upstream is gone, starting the grace period.
+// Satisfies the ConnectCloser interface.
+func (streamer *Streamer) Close() error {
+	for _, extraction := range streamer.extracted() {
+		extraction.child.Close()
+	}
+	StoreBool(&streamer.reconnected, true)
+	
+	streamer.lock.Lock()
+	
+	if !LoadBool(&streamer.online) || streamer.grace != nil {
+		streamer.lock.Unlock()
+		return ErrNotRunning
+	}
+	if streamer.fallback != nil {
+		StoreBool(&streamer.online, false)
+		streamer.ready = make(chan struct{})
+		streamer.logger.Log(Dict{
+			"event": eventStreamerOffline,
+			"message": "Upstream disconnected, switching to fallback",
+		})
+		streamer.lock.Unlock()
+		// the streaming goroutine may need the lock before it takes the request
+		streamer.request<- ConnectionRequest{
+			Command: streamerCommandFallback,
+		}
+		return nil
+	}
+	defer streamer.lock.Unlock()
+	streamer.logger.Log(Dict{
+		"event": eventStreamerOffline,
+		"grace": streamer.Grace.Seconds(),
+		"message": fmt.Sprintf("Upstream disconnected, keeping clients for %0.0f seconds", streamer.Grace.Seconds()),
+	})
+	if streamer.Grace > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(streamer.Grace, func() {
+			streamer.lock.Lock()
+			defer streamer.lock.Unlock()
+			// the upstream may have come back while we were waiting for the lock
+			if streamer.grace == timer {
+				streamer.expire()
+			}
+		})
+		streamer.grace = timer
+	} else {
+		streamer.expire()
+	}
+	return nil
+}
+
+// Extract feeds a program of this stream into another streamer,
+// as a single program transport stream. The PAT is rewritten to only
+// contain the program, which is passed on with its PMT and all its PIDs.
+//
+// The child follows the upstream state of this stream, but has its own
+// clients, statistics and fallback. It stops when this stream stops.
+// If this stream is connected on demand, viewers of the child count as viewers of this stream.
+// qsize is the input queue size of the child, in packets.
+func (streamer *Streamer) Extract(number uint16, child *Streamer, qsize uint) {
+	extraction := &extraction{
+		filter: newOutputFilter(OutputProfile{
+			Programs: []uint16{ number },
+		}),
+		child: child,
+		queue: make(chan *Batch, BatchQueueSize(qsize)),
+	}
+	if streamer.demand != nil {
+		child.SetDemandListener(streamer)
+	}
+	go child.Stream(extraction.queue)
+	
+	streamer.lock.Lock()
+	// the capacity limit makes append copy, the current slice may be in use
+	current := streamer.extracted()
+	streamer.extractions.Store(append(current[:len(current):len(current)], extraction))
+	online := LoadBool(&streamer.online)
+	streamer.lock.Unlock()
+	
+	if online {
+		child.Connect()
+	}
+}
+
+// extracted returns the programs that are extracted from this stream.
+// The returned slice must not be modified.
+func (streamer *Streamer) extracted() []*extraction {
+	extractions, _ := streamer.extractions.Load().([]*extraction)
+	return extractions
+}
+
+// Demand counts a viewer of a program that is extracted from this stream.
+// Satisfies the DemandListener interface.
+func (streamer *Streamer) Demand() {
+	streamer.lock.Lock()
+	defer streamer.lock.Unlock()
+	
+	streamer.viewers++
+	if streamer.viewers == 1 {
+		streamer.logger.Log(Dict{
+			"event": eventStreamerDemand,
+			"message": "First viewer of an extracted program arrived, requesting upstream",
+		})
+		streamer.demand.Demand()
+	}
+}
+
+// Idle removes a viewer of a program that is extracted from this stream.
+// Satisfies the DemandListener interface.
+func (streamer *Streamer) Idle() {
+	streamer.detach()
+}
+
+// expire takes the stream offline and drops all clients.
+// Must be called with the lock held.
+func (streamer *Streamer) expire() {
+	streamer.grace = nil
+	StoreBool(&streamer.online, false)
+	streamer.ready = make(chan struct{})
+	streamer.logger.Log(Dict{
+		"event": eventStreamerExpired,
+		"message": "Upstream did not come back, dropping clients",
+	})
+	streamer.manager.Notify()
 }
 
 // eatCommands is started in the background to drain the command
@@ -175,10 +458,12 @@ func (streamer *Streamer) eatCommands() {
 
 // Stream is the main stream multiplier loop.
 // It reads data from the input queue and distributes it to the connections.
+// Batches are shared between all connections and released when
+// the last connection has sent them.
 //
 // This routine will block; you should run it asynchronously like this:
 //
-// queue := make(chan Packet, inputQueueSize)
+// queue := make(chan *Batch, BatchQueueSize(inputQueueSize))
 // go func() {
 //   log.Fatal(streamer.Stream(queue))
 // }
@@ -186,7 +471,7 @@ func (streamer *Streamer) eatCommands() {
 // or simply:
 //
 // go streamer.Stream(queue)
-func (streamer *Streamer) Stream(queue <-chan Packet) error {
+func (streamer *Streamer) Stream(queue <-chan *Batch) error {
 	// interlock and check for availability first
 	if !CompareAndSwapBool(&streamer.running, false, true) {
 		return ErrAlreadyRunning
@@ -195,6 +480,13 @@ func (streamer *Streamer) Stream(queue <-chan Packet) error {
 	// create the local outgoing connection pool
 	pool := make(map[*Connection]bool)
 	
+	// keeps the output consistent when switching between upstream and fallback
+	splicer := newSplicer()
+	streamer.monitor.timeout = streamer.PidTimeout
+	// fallback packets arrive here while the fallback is playing
+	var slate chan *Batch
+	var stop chan struct{}
+	
 	// stop the eater process
 	streamer.request<- ConnectionRequest{
 		Command: streamerCommandStart,
@@ -205,40 +497,61 @@ func (streamer *Streamer) Stream(queue <-chan Packet) error {
 		"message": "Starting streaming",
 	})
 	
+	// play the fallback until the upstream delivers
+	if streamer.fallback != nil {
+		slate = make(chan *Batch)
+		stop = make(chan struct{})
+		go streamer.playFallback(slate, stop)
+	}
+	
 	// loop until the input channel is closed
 	running := true
 	for running {
 		select {
-			case packet, ok := <-queue:
+			case batch, ok := <-queue:
 				if ok {
-					// got a packet, distribute
-					//log.Printf("Got packet (length %d):\n%s\n", len(packet), hex.Dump(packet))
-					//log.Printf("Got packet (length %d)\n", len(packet))
+					// the upstream is back, stop the fallback
+					if slate != nil {
+						streamer.logger.Log(Dict{
+							"event": eventStreamerResume,
+							"message": "Upstream is back, stopping fallback",
+						})
+						close(stop)
+						slate = nil
+						splicer.splice()
+					}
 					
-					for conn, _ := range pool {
-						select {
-							case conn.Queue<- packet:
-								// packet distributed, done
-								//log.Printf("Queued packet (length %d):\n%s\n", len(packet), hex.Dump(packet))
-								
-								// report the packet
-								streamer.stats.PacketSent()
-							default:
-								// queue is full
-								//log.Print(ErrSlowRead)
-								
-								// report the drop
-								streamer.stats.PacketDropped()
-						}
+					// got some packets, track the programs, check them and distribute
+					//log.Printf("Got batch (length %d)\n", batch.Len())
+					streamer.psi.demux(batch)
+					if SwapBool(&streamer.reconnected, false) {
+						streamer.monitor.resume()
 					}
+					streamer.monitor.inspect(batch)
+					streamer.extract(batch)
+					streamer.distribute(pool, splicer, batch, true)
 				} else {
 					// channel closed, exit
 					running = false
 					// and stop everything
 					StoreBool(&streamer.running, false)
+					StoreBool(&streamer.online, false)
 				}
+			case batch := <-slate:
+				streamer.distribute(pool, splicer, batch, false)
 			case request := <-streamer.request:
 				switch request.Command {
+					case streamerCommandFallback:
+						if slate == nil && streamer.fallback != nil {
+							streamer.logger.Log(Dict{
+								"event": eventStreamerFallback,
+								"message": "Playing fallback",
+							})
+							slate = make(chan *Batch)
+							stop = make(chan struct{})
+							go streamer.playFallback(slate, stop)
+							splicer.splice()
+						}
 					case StreamerCommandRemove:
 						streamer.logger.Log(Dict{
 							"event": eventStreamerClientRemove,
@@ -263,12 +576,22 @@ func (streamer *Streamer) Stream(queue <-chan Packet) error {
 	}
 	
 	// clean up
-	for _ = range queue {
+	if slate != nil {
+		close(stop)
+	}
+	for batch := range queue {
 		// drain any leftovers
+		batch.Release()
 	}
 	for conn, _ := range pool {
 		close(conn.Queue)
 	}
+	streamer.lock.Lock()
+	for _, extraction := range streamer.extracted() {
+		close(extraction.queue)
+	}
+	streamer.extractions.Store([]*extraction(nil))
+	streamer.lock.Unlock()
 	
 	// start the command eater again
 	go streamer.eatCommands()
@@ -280,24 +603,160 @@ func (streamer *Streamer) Stream(queue <-chan Packet) error {
 	return nil
 }
 
+// playFallback plays the fallback until stop is closed and logs playback errors.
+func (streamer *Streamer) playFallback(slate chan<- *Batch, stop <-chan struct{}) {
+	if err := streamer.fallback.play(slate, stop); err != nil {
+		streamer.logger.Log(Dict{
+			"event": eventStreamerError,
+			"error": errorStreamerFallback,
+			"message": fmt.Sprintf("Cannot play fallback: %s", err),
+		})
+	}
+}
+
+// distribute runs a batch through the splicer and sends it to all connections
+// in the pool. The reference held by the caller is consumed.
+// If filtered is true, connections with an output profile get filtered batches.
+func (streamer *Streamer) distribute(pool map[*Connection]bool, splicer *splicer, batch *Batch, filtered bool) {
+	for _, packet := range batch.Packets {
+		splicer.process(packet)
+	}
+	if filtered {
+		streamer.filter(pool, batch)
+	} else {
+		streamer.broadcast(pool, batch)
+	}
+	batch.Release()
+}
+
+// extract filters a batch for each extracted program and queues
+// the result on the child streamer. Batches that do not fit are dropped.
+func (streamer *Streamer) extract(batch *Batch) {
+	for _, extraction := range streamer.extracted() {
+		for _, part := range extraction.filter.apply(streamer.psi, batch) {
+			if part.Len() == 0 {
+				part.Release()
+				continue
+			}
+			select {
+				case extraction.queue<- part:
+					// the child takes over the reference
+				default:
+					// the child is not keeping up
+					extraction.child.stats.PacketsDropped(part.Len())
+					part.Release()
+			}
+		}
+	}
+}
+
+// filter sends a batch to all connections in the pool,
+// filtering it once for each output filter in use.
+func (streamer *Streamer) filter(pool map[*Connection]bool, batch *Batch) {
+	var filtered map[*outputFilter][]*Batch
+	for conn, _ := range pool {
+		if conn.filter == nil {
+			streamer.send(conn, batch)
+			continue
+		}
+		if filtered == nil {
+			filtered = make(map[*outputFilter][]*Batch)
+		}
+		output, ok := filtered[conn.filter]
+		if !ok {
+			output = conn.filter.apply(streamer.psi, batch)
+			filtered[conn.filter] = output
+		}
+		for _, part := range output {
+			if part.Len() > 0 {
+				streamer.send(conn, part)
+			}
+		}
+	}
+	for _, output := range filtered {
+		for _, part := range output {
+			part.Release()
+		}
+	}
+}
+
+// broadcast sends a batch to all connections in the pool.
+// Each connection that accepts the batch gets its own reference.
+func (streamer *Streamer) broadcast(pool map[*Connection]bool, batch *Batch) {
+	for conn, _ := range pool {
+		streamer.send(conn, batch)
+	}
+}
+
+// send queues a batch on a connection, with its own reference.
+func (streamer *Streamer) send(conn *Connection, batch *Batch) {
+	batch.Retain()
+	select {
+		case conn.Queue<- batch:
+			// batch distributed, done
+			//log.Printf("Queued batch (length %d)\n", batch.Len())
+			
+			// report the packets
+			streamer.stats.PacketsSent(batch.Len())
+		default:
+			// queue is full
+			//log.Print(ErrSlowRead)
+			batch.Release()
+			
+			// report the drop
+			streamer.stats.PacketsDropped(batch.Len())
+	}
+}
+
 // ServeHTTP handles an incoming HTTP connection.
 // Satisfies the http.Handler interface, so it can be used in an HTTP server.
 func (streamer *Streamer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	var conn *Connection = nil
 	
-	// prevent race conditions first
-	if LoadBool(&streamer.running) {
+	// select the components the client wants
+	filter, ok := streamer.acquireFilter(request)
+	if !ok {
+		ServeStreamError(writer, http.StatusBadRequest)
+		return
+	}
+	if filter != nil {
+		defer streamer.releaseFilter(filter)
+	}
+	
+	// bring up the upstream if needed
+	if streamer.demand != nil {
+		defer streamer.detach()
+		if !streamer.attach(request) {
+			// the viewer left while waiting
+			return
+		}
+	}
+	
+	// check the state and register for the end of the grace period in one step,
+	// so a grace period that expires in between does not miss the connection
+	streamer.lock.Lock()
+	available := LoadBool(&streamer.running) && (LoadBool(&streamer.online) || streamer.fallback != nil)
+	if available {
+		conn = NewConnection(writer, streamer.queueSize)
+		conn.SetLogger(streamer.logger.Logger)
+		conn.filter = filter
+		streamer.manager.Register(conn.shutdown)
+	}
+	streamer.lock.Unlock()
+	
+	if available {
 		// check if the connection can be accepted
 		if streamer.broker.Accept(request.RemoteAddr, streamer) {
-			conn = NewConnection(writer, streamer.queueSize)
-			conn.SetLogger(streamer.logger.Logger)
-			
 			streamer.request<- ConnectionRequest{
 				Command: StreamerCommandAdd,
 				Address: request.RemoteAddr,
 				Connection: conn,
 			}
 		} else {
+			streamer.lock.Lock()
+			streamer.manager.Unregister(conn.shutdown)
+			streamer.lock.Unlock()
+			conn = nil
 			streamer.logger.Log(Dict{
 				"event": eventStreamerError,
 				"error": errorStreamerPoolFull,
@@ -322,6 +781,10 @@ func (streamer *Streamer) ServeHTTP(writer http.ResponseWriter, request *http.Re
 		})
 		conn.Serve()
 		
+		streamer.lock.Lock()
+		streamer.manager.Unregister(conn.shutdown)
+		streamer.lock.Unlock()
+		
 		// done, remove the stale connection
 		streamer.request<- ConnectionRequest{
 			Command: StreamerCommandRemove,
@@ -329,8 +792,9 @@ func (streamer *Streamer) ServeHTTP(writer http.ResponseWriter, request *http.Re
 			Connection: conn,
 		}
 		// and drain the queue AFTER we have sent the shutdown signal
-		for _ = range conn.Queue {
+		for batch := range conn.Queue {
 			// drain any leftovers
+			batch.Release()
 		}
 		streamer.logger.Log(Dict{
 			"event": eventStreamerClosed,
@@ -349,3 +813,113 @@ func (streamer *Streamer) ServeHTTP(writer http.ResponseWriter, request *http.Re
 		ServeStreamError(writer, http.StatusNotFound)
 	}
 }
+
+// acquireFilter returns the output filter for the profile that a request selects,
+// or nil if it selects everything. Connections with the same profile share a filter.
+// ok is false if the request selects an unknown profile or invalid PIDs.
+func (streamer *Streamer) acquireFilter(request *http.Request) (filter *outputFilter, ok bool) {
+	query := request.URL.Query()
+	var profile OutputProfile
+	if name := query.Get("profile"); name != "" {
+		profile, ok = streamer.profiles[name]
+		if !ok {
+			streamer.logger.Log(Dict{
+				"event": eventStreamerError,
+				"error": errorStreamerProfile,
+				"profile": name,
+				"message": fmt.Sprintf("Refusing connection from %s, unknown profile %s", request.RemoteAddr, name),
+			})
+			return nil, false
+		}
+	} else {
+		var err error
+		profile, err = ParseOutputProfile(query)
+		if err != nil {
+			streamer.logger.Log(Dict{
+				"event": eventStreamerError,
+				"error": errorStreamerProfile,
+				"message": fmt.Sprintf("Refusing connection from %s: %s", request.RemoteAddr, err),
+			})
+			return nil, false
+		}
+	}
+	if profile.Empty() {
+		return nil, true
+	}
+	
+	key := profile.key()
+	streamer.lock.Lock()
+	defer streamer.lock.Unlock()
+	filter = streamer.filters[key]
+	if filter == nil {
+		filter = newOutputFilter(profile)
+		streamer.filters[key] = filter
+	}
+	filter.users++
+	return filter, true
+}
+
+// releaseFilter drops a filter when its last connection is gone.
+func (streamer *Streamer) releaseFilter(filter *outputFilter) {
+	streamer.lock.Lock()
+	defer streamer.lock.Unlock()
+	filter.users--
+	if filter.users == 0 {
+		delete(streamer.filters, filter.key)
+	}
+}
+
+// attach counts a viewer and waits until the upstream is online,
+// notifying the demand listener if it is the first one.
+// Returns false if the viewer went away while waiting.
+// The viewer must be removed with detach in any case.
+func (streamer *Streamer) attach(request *http.Request) bool {
+	address := request.RemoteAddr
+	// notify under the lock, so Demand and Idle calls are never reordered
+	streamer.lock.Lock()
+	streamer.viewers++
+	if streamer.viewers == 1 {
+		streamer.logger.Log(Dict{
+			"event": eventStreamerDemand,
+			"message": fmt.Sprintf("First viewer %s arrived, requesting upstream", address),
+		})
+		streamer.demand.Demand()
+	}
+	ready := streamer.ready
+	streamer.lock.Unlock()
+	
+	var expired <-chan time.Time
+	if streamer.DemandTimeout > 0 {
+		timer := time.NewTimer(streamer.DemandTimeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+		case <-ready:
+		case <-expired:
+			streamer.logger.Log(Dict{
+				"event": eventStreamerError,
+				"error": errorStreamerDemandTimeout,
+				"message": fmt.Sprintf("Upstream did not come online in time for %s", address),
+			})
+		case <-request.Context().Done():
+			return false
+	}
+	return true
+}
+
+// detach removes a viewer and notifies the demand listener
+// if it was the last one.
+func (streamer *Streamer) detach() {
+	streamer.lock.Lock()
+	defer streamer.lock.Unlock()
+	
+	streamer.viewers--
+	if streamer.viewers == 0 {
+		streamer.logger.Log(Dict{
+			"event": eventStreamerIdle,
+			"message": "Last viewer left",
+		})
+		streamer.demand.Idle()
+	}
+}
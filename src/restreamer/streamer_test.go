@@ -0,0 +1,95 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testBroker accepts all connections.
+type testBroker struct{}
+
+func (*testBroker) Accept(remoteaddr string, streamer *Streamer) bool {
+	return true
+}
+
+func (*testBroker) Release(streamer *Streamer) {
+}
+
+// testDemand records the demand notifications of a streamer.
+type testDemand struct {
+	demand chan struct{}
+	idle chan struct{}
+}
+
+func (listener *testDemand) Demand() {
+	listener.demand <- struct{}{}
+}
+
+func (listener *testDemand) Idle() {
+	listener.idle <- struct{}{}
+}
+
+// TestStreamerViewerCancel checks that a viewer who leaves while the
+// upstream is connecting on demand is not counted any more.
+func TestStreamerViewerCancel(t *testing.T) {
+	streamer := NewStreamer(16, &testBroker{})
+	streamer.SetLogger(&DummyLogger{})
+	listener := &testDemand{
+		demand: make(chan struct{}, 1),
+		idle: make(chan struct{}, 1),
+	}
+	streamer.SetDemandListener(listener)
+	queue := make(chan *Batch)
+	go streamer.Stream(queue)
+	defer close(queue)
+	
+	ctx, cancel := context.WithCancel(context.Background())
+	request := httptest.NewRequest("GET", "/stream", nil).WithContext(ctx)
+	served := make(chan struct{})
+	go func() {
+		streamer.ServeHTTP(httptest.NewRecorder(), request)
+		close(served)
+	}()
+	
+	select {
+		case <-listener.demand:
+		case <-time.After(time.Second):
+			t.Fatal("upstream was not requested")
+	}
+	cancel()
+	select {
+		case <-served:
+		case <-time.After(time.Second):
+			t.Fatal("viewer is still waiting after it went away")
+	}
+	select {
+		case <-listener.idle:
+		case <-time.After(time.Second):
+			t.Fatal("upstream is still requested after the viewer went away")
+	}
+	
+	streamer.lock.Lock()
+	viewers := streamer.viewers
+	streamer.lock.Unlock()
+	if viewers != 0 {
+		t.Errorf("viewers = %d, want 0", viewers)
+	}
+}
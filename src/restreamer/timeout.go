@@ -0,0 +1,155 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"io"
+	"net"
+	"time"
+	"errors"
+	"context"
+	"net/http"
+)
+
+var (
+	// ErrReadTimeout is thrown when an upstream did not send any data within the read timeout.
+	ErrReadTimeout = errors.New("restreamer: read timeout")
+)
+
+// deadliner is implemented by sources that support read deadlines, like net.Conn.
+type deadliner interface {
+	SetReadDeadline(time.Time) error
+}
+
+// canceler is implemented by sources that can abort a pending read without closing.
+type canceler interface {
+	Cancel()
+}
+
+// cancelReader is an HTTP response body whose request can be aborted
+// through its context.
+type cancelReader struct {
+	io.ReadCloser
+	// cancel cancels the request context
+	cancel context.CancelFunc
+}
+
+// Cancel aborts the request, pending reads will fail.
+func (reader *cancelReader) Cancel() {
+	reader.cancel()
+}
+
+// Close closes the response body and releases the context.
+func (reader *cancelReader) Close() error {
+	reader.cancel()
+	return reader.ReadCloser.Close()
+}
+
+// requestBody is the body of an incoming HTTP request, with read deadlines
+// set through the response controller of the request.
+type requestBody struct {
+	io.ReadCloser
+	// controller controls the connection of the request
+	controller *http.ResponseController
+}
+
+// newRequestBody wraps the body of a request that is answered through writer.
+func newRequestBody(writer http.ResponseWriter, request *http.Request) *requestBody {
+	return &requestBody{
+		ReadCloser: request.Body,
+		controller: http.NewResponseController(writer),
+	}
+}
+
+// SetReadDeadline sets the read deadline of the request connection.
+// Fails if the server does not support it.
+func (body *requestBody) SetReadDeadline(deadline time.Time) error {
+	return body.controller.SetReadDeadline(deadline)
+}
+
+// timeoutReader makes reads fail with ErrReadTimeout when no data
+// arrives within a timeout.
+//
+// Sources that support read deadlines get a new deadline before each read.
+// Other sources are watched by a single timer that is rearmed after each read,
+// and that cancels the source (or closes it, if it can't be cancelled) when it fires.
+type timeoutReader struct {
+	// input is the source
+	input io.ReadCloser
+	// timeout is the read timeout
+	timeout time.Duration
+	// deadline is set if the source supports read deadlines
+	deadline deadliner
+	// timer is the watchdog for sources without deadlines
+	timer *time.Timer
+	// expired is set when the watchdog has fired
+	expired AtomicBool
+}
+
+// newTimeoutReader wraps a source with a read timeout.
+// Call Stop() when the reader is no longer used.
+func newTimeoutReader(input io.ReadCloser, timeout time.Duration) *timeoutReader {
+	reader := &timeoutReader{
+		input: input,
+		timeout: timeout,
+		expired: AtomicFalse,
+	}
+	// not all files support deadlines, so try first
+	if deadline, ok := input.(deadliner); ok && deadline.SetReadDeadline(time.Time{}) == nil {
+		reader.deadline = deadline
+	} else {
+		reader.timer = time.AfterFunc(timeout, reader.expire)
+	}
+	return reader
+}
+
+// expire is called by the watchdog and aborts the pending read.
+func (reader *timeoutReader) expire() {
+	StoreBool(&reader.expired, true)
+	if cancel, ok := reader.input.(canceler); ok {
+		cancel.Cancel()
+	} else {
+		reader.input.Close()
+	}
+}
+
+// Read reads from the source, failing with ErrReadTimeout if no data arrives in time.
+func (reader *timeoutReader) Read(data []byte) (int, error) {
+	if reader.deadline != nil {
+		reader.deadline.SetReadDeadline(time.Now().Add(reader.timeout))
+		count, err := reader.input.Read(data)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = ErrReadTimeout
+		}
+		return count, err
+	}
+	
+	count, err := reader.input.Read(data)
+	if LoadBool(&reader.expired) {
+		return count, ErrReadTimeout
+	}
+	reader.timer.Reset(reader.timeout)
+	return count, err
+}
+
+// Stop disables the watchdog.
+func (reader *timeoutReader) Stop() {
+	if reader.timer != nil {
+		reader.timer.Stop()
+	}
+}
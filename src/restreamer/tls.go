@@ -0,0 +1,275 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/x509"
+)
+
+const (
+	moduleTls = "tls"
+	//
+	eventTlsLoaded = "loaded"
+	eventTlsError = "error"
+	//
+	errorTlsReload = "reload"
+)
+
+var (
+	// ErrInvalidTlsVersion is thrown when an unknown minimum TLS version was configured.
+	ErrInvalidTlsVersion = errors.New("restreamer: invalid TLS version, use 1.0, 1.1, 1.2 or 1.3")
+	// ErrNoCertificates is thrown when a CA bundle does not contain any usable certificates.
+	ErrNoCertificates = errors.New("restreamer: no certificates found in CA bundle")
+	// ErrIncompleteKeyPair is thrown when only one of client certificate and key was configured.
+	ErrIncompleteKeyPair = errors.New("restreamer: client certificate and key must be given together")
+	// ErrNoPeerCertificate is thrown when a server did not present a certificate.
+	ErrNoPeerCertificate = errors.New("restreamer: server did not present a certificate")
+)
+
+// tlsVersions maps configuration values to TLS protocol versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TlsConfig contains the TLS settings for connections to https upstreams.
+// All file names refer to PEM files.
+type TlsConfig struct {
+	// Ca is a bundle of trusted CA certificates, replacing the system trust store
+	Ca string `json:"ca"`
+	// Cert is the client certificate for mutual TLS
+	Cert string `json:"cert"`
+	// Key is the private key of the client certificate
+	Key string `json:"key"`
+	// ServerName overrides the host name that is sent with SNI and verified in the server certificate
+	ServerName string `json:"servername"`
+	// MinVersion is the minimum TLS protocol version (1.0, 1.1, 1.2 or 1.3)
+	MinVersion string `json:"minversion"`
+	// Insecure disables server certificate verification. Only use this for testing.
+	Insecure bool `json:"insecure"`
+}
+
+// TlsLoader builds TLS client configurations and reloads the certificates
+// when their files change on disk.
+type TlsLoader struct {
+	// config is the TLS settings
+	config TlsConfig
+	// version is the parsed minimum TLS version
+	version uint16
+	// lock protects cached and stamps
+	lock sync.Mutex
+	// cached is the current TLS configuration
+	cached *tls.Config
+	// stamps are the modification times of the files cached was built from
+	stamps []time.Time
+	// logger is a json logger
+	logger *ModuleLogger
+}
+
+// NewTlsLoader validates TLS settings and loads the certificates.
+func NewTlsLoader(config TlsConfig) (*TlsLoader, error) {
+	version := uint16(0)
+	if config.MinVersion != "" {
+		var ok bool
+		version, ok = tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, ErrInvalidTlsVersion
+		}
+	}
+	if (config.Cert == "") != (config.Key == "") {
+		return nil, ErrIncompleteKeyPair
+	}
+	loader := &TlsLoader{
+		config: config,
+		version: version,
+		logger: &ModuleLogger{
+			Logger: &ConsoleLogger{},
+			Defaults: Dict{
+				"module": moduleTls,
+			},
+			AddTimestamp: true,
+		},
+	}
+	if _, err := loader.Config(); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// SetLogger assigns a logger
+func (loader *TlsLoader) SetLogger(logger JsonLogger) {
+	loader.logger.Logger = logger
+}
+
+// Config returns the current TLS configuration, reloading certificates if
+// any of the files were modified.
+//
+// If reloading fails, for example because only the certificate has been
+// replaced yet and does not match the old key, the previous configuration
+// stays in use and reloading is retried on the next call.
+func (loader *TlsLoader) Config() (*tls.Config, error) {
+	loader.lock.Lock()
+	defer loader.lock.Unlock()
+	
+	stamps := loader.modified()
+	if loader.cached != nil && equalTimes(stamps, loader.stamps) {
+		return loader.cached, nil
+	}
+	
+	config, err := loader.load()
+	if err != nil {
+		if loader.cached != nil {
+			loader.logger.Log(Dict{
+				"event": eventTlsError,
+				"error": errorTlsReload,
+				"message": fmt.Sprintf("Error reloading TLS certificates, keeping the old ones: %s", err),
+			})
+			return loader.cached, nil
+		}
+		return nil, err
+	}
+	if loader.cached != nil {
+		loader.logger.Log(Dict{
+			"event": eventTlsLoaded,
+			"message": "Reloaded TLS certificates",
+		})
+	}
+	loader.cached = config
+	loader.stamps = stamps
+	return config, nil
+}
+
+// ClientConfig returns a TLS configuration for http.Transport.TLSClientConfig.
+//
+// The client certificate and the trusted CAs are looked up on each handshake,
+// so reloaded certificates are used without replacing the transport.
+// Unlike a custom dialer, this also applies to upstreams that are reached
+// through an HTTPS proxy.
+func (loader *TlsLoader) ClientConfig() *tls.Config {
+	return &tls.Config{
+		ServerName: loader.config.ServerName,
+		MinVersion: loader.version,
+		// the server certificate is checked by verify, against the current CAs
+		InsecureSkipVerify: true,
+		VerifyConnection: loader.verify,
+		GetClientCertificate: loader.certificate,
+	}
+}
+
+// certificate returns the current client certificate.
+// If none is configured, an empty one is sent.
+func (loader *TlsLoader) certificate(request *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	config, err := loader.Config()
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Certificates) == 0 {
+		return &tls.Certificate{}, nil
+	}
+	return &config.Certificates[0], nil
+}
+
+// verify checks the certificate chain and the host name of a server
+// against the current trusted CAs, or the system trust store if none are configured.
+func (loader *TlsLoader) verify(state tls.ConnectionState) error {
+	config, err := loader.Config()
+	if err != nil {
+		return err
+	}
+	if config.InsecureSkipVerify {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return ErrNoPeerCertificate
+	}
+	options := x509.VerifyOptions{
+		Roots: config.RootCAs,
+		DNSName: state.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, certificate := range state.PeerCertificates[1:] {
+		options.Intermediates.AddCert(certificate)
+	}
+	_, err = state.PeerCertificates[0].Verify(options)
+	return err
+}
+
+// load builds a TLS configuration from the settings and the certificate files.
+func (loader *TlsLoader) load() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: loader.config.ServerName,
+		MinVersion: loader.version,
+		InsecureSkipVerify: loader.config.Insecure,
+	}
+	if loader.config.Ca != "" {
+		pem, err := ioutil.ReadFile(loader.config.Ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrNoCertificates
+		}
+		config.RootCAs = pool
+	}
+	if loader.config.Cert != "" {
+		certificate, err := tls.LoadX509KeyPair(loader.config.Cert, loader.config.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{ certificate }
+	}
+	return config, nil
+}
+
+// modified returns the modification times of the configured files.
+// Files that can't be accessed have a zero time.
+func (loader *TlsLoader) modified() []time.Time {
+	files := []string{ loader.config.Ca, loader.config.Cert, loader.config.Key }
+	stamps := make([]time.Time, len(files))
+	for i, file := range files {
+		if file != "" {
+			info, err := os.Stat(file)
+			if err == nil {
+				stamps[i] = info.ModTime()
+			}
+		}
+	}
+	return stamps
+}
+
+// equalTimes returns true if both lists contain the same times.
+func equalTimes(a []time.Time, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
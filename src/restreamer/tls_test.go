@@ -0,0 +1,192 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"io"
+	"net"
+	"time"
+	"testing"
+	"net/url"
+	"net/http"
+	"math/big"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/elliptic"
+	"path/filepath"
+	"sync/atomic"
+	"net/http/httptest"
+	"crypto/x509/pkix"
+)
+
+// testCertificate creates a certificate signed by parent, or a self-signed CA if parent is nil.
+func testCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{ CommonName: name },
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IPAddresses: []net.IP{ net.ParseIP("127.0.0.1") },
+		ExtKeyUsage: []x509.ExtKeyUsage{ x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth },
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+// writePem writes a certificate or key to a PEM file and returns its name.
+func writePem(t *testing.T, dir string, name string, kind string, der []byte) string {
+	file := filepath.Join(dir, name)
+	err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{ Type: kind, Bytes: der }), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// testConnectProxy is an HTTP proxy that tunnels CONNECT requests.
+type testConnectProxy struct {
+	tunnels int32
+}
+
+func (proxy *testConnectProxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "CONNECT" {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	upstream, err := net.Dial("tcp", request.Host)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	downstream, _, err := http.NewResponseController(writer).Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	atomic.AddInt32(&proxy.tunnels, 1)
+	downstream.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		io.Copy(upstream, downstream)
+		upstream.Close()
+	}()
+	io.Copy(downstream, upstream)
+	downstream.Close()
+}
+
+// TestTlsThroughProxy checks that the CA bundle and the client certificate
+// are used for upstreams that are reached through a proxy.
+func TestTlsThroughProxy(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := testCertificate(t, "ca", nil, nil)
+	server, serverKey := testCertificate(t, "server", ca, caKey)
+	client, clientKey := testCertificate(t, "client", ca, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("ok"))
+	}))
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{ server.Raw },
+			PrivateKey: serverKey,
+		}},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: pool,
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+	
+	tunnel := &testConnectProxy{}
+	proxy := httptest.NewServer(tunnel)
+	defer proxy.Close()
+	proxyUrl, _ := url.Parse(proxy.URL)
+	
+	clientKeyDer, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := TlsConfig{
+		Ca: writePem(t, dir, "ca.pem", "CERTIFICATE", ca.Raw),
+		Cert: writePem(t, dir, "client.pem", "CERTIFICATE", client.Raw),
+		Key: writePem(t, dir, "client.key", "EC PRIVATE KEY", clientKeyDer),
+	}
+	get := func(settings TlsConfig) error {
+		loader, err := NewTlsLoader(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loader.SetLogger(&DummyLogger{})
+		getter := &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyURL(proxyUrl),
+				TLSClientConfig: loader.ClientConfig(),
+				DisableKeepAlives: true,
+			},
+		}
+		response, err := getter.Get(upstream.URL)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		return nil
+	}
+	
+	if err := get(settings); err != nil {
+		t.Fatalf("request with CA and client certificate failed: %s", err)
+	}
+	if atomic.LoadInt32(&tunnel.tunnels) == 0 {
+		t.Fatal("request did not go through the proxy")
+	}
+	
+	// without the CA, the server certificate is not trusted
+	untrusted := settings
+	untrusted.Ca = ""
+	if err := get(untrusted); err == nil {
+		t.Error("request without the CA bundle succeeded")
+	}
+	
+	// without the client certificate, the server refuses the connection
+	anonymous := settings
+	anonymous.Cert = ""
+	anonymous.Key = ""
+	if err := get(anonymous); err == nil {
+		t.Error("request without a client certificate succeeded")
+	}
+}
@@ -0,0 +1,109 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+const (
+	// NullPid is the PID of stuffing packets
+	NullPid = 0x1fff
+	// PidCount is the number of possible PIDs
+	PidCount = 0x2000
+	// PcrClock is the frequency of the program clock reference, in Hz
+	PcrClock = 27000000
+)
+
+// Pid returns the packet identifier.
+func (packet Packet) Pid() uint16 {
+	return uint16(packet[1] & 0x1f) << 8 | uint16(packet[2])
+}
+
+// TransportError returns true if the transport error indicator is set,
+// meaning that the packet is damaged.
+func (packet Packet) TransportError() bool {
+	return packet[1] & 0x80 != 0
+}
+
+// Scrambled returns true if the payload of the packet is scrambled.
+func (packet Packet) Scrambled() bool {
+	return packet[3] & 0xc0 != 0
+}
+
+// PayloadStart returns true if a PES packet or PSI section starts in this packet.
+func (packet Packet) PayloadStart() bool {
+	return packet[1] & 0x40 != 0
+}
+
+// HasAdaptationField returns true if the packet contains an adaptation field.
+func (packet Packet) HasAdaptationField() bool {
+	return packet[3] & 0x20 != 0
+}
+
+// HasPayload returns true if the packet contains payload data.
+func (packet Packet) HasPayload() bool {
+	return packet[3] & 0x10 != 0
+}
+
+// ContinuityCounter returns the 4-bit continuity counter.
+func (packet Packet) ContinuityCounter() uint8 {
+	return packet[3] & 0x0f
+}
+
+// SetContinuityCounter replaces the continuity counter.
+func (packet Packet) SetContinuityCounter(counter uint8) {
+	packet[3] = packet[3] & 0xf0 | counter & 0x0f
+}
+
+// Discontinuity returns true if the discontinuity indicator is set in the adaptation field.
+func (packet Packet) Discontinuity() bool {
+	return packet.HasAdaptationField() && packet[4] > 0 && packet[5] & 0x80 != 0
+}
+
+// SetDiscontinuity sets the discontinuity indicator in the adaptation field.
+// Returns false if the packet has no adaptation field that could carry the flag.
+func (packet Packet) SetDiscontinuity() bool {
+	if !packet.HasAdaptationField() || packet[4] == 0 {
+		return false
+	}
+	packet[5] |= 0x80
+	return true
+}
+
+// Pcr returns the program clock reference in units of PcrClock.
+// ok is false if the packet does not carry a PCR.
+func (packet Packet) Pcr() (pcr uint64, ok bool) {
+	if !packet.HasAdaptationField() || packet[4] < 7 || packet[5] & 0x10 == 0 {
+		return 0, false
+	}
+	base := uint64(packet[6]) << 25 | uint64(packet[7]) << 17 | uint64(packet[8]) << 9 | uint64(packet[9]) << 1 | uint64(packet[10]) >> 7
+	extension := uint64(packet[10] & 0x01) << 8 | uint64(packet[11])
+	return base * 300 + extension, true
+}
+
+// Payload returns the packet payload, after the header and adaptation field.
+// Returns nil if there is no payload.
+func (packet Packet) Payload() []byte {
+	if !packet.HasPayload() {
+		return nil
+	}
+	start := 4
+	if packet.HasAdaptationField() {
+		start += 1 + int(packet[4])
+	}
+	if start >= PacketSize {
+		return nil
+	}
+	return packet[start:]
+}
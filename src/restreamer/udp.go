@@ -0,0 +1,223 @@
+/* Copyright (c) 2017 Gregor Riepl
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package restreamer
+
+import (
+	"net"
+	"errors"
+	"time"
+	"runtime"
+	"syscall"
+	"net/url"
+)
+
+const (
+	// udpDatagramSize is the largest datagram we expect to receive.
+	// Multicast TS usually carries 7 packets (1316 bytes) per datagram,
+	// but jumbo frames or RTP headers can make them larger.
+	udpDatagramSize = 65536
+	// udpReceiveBuffer is the requested socket receive buffer size.
+	// Large enough to survive short scheduling hiccups at high bitrates.
+	udpReceiveBuffer = 4 * 1024 * 1024
+	// ipAddSourceMembershipLinux is IP_ADD_SOURCE_MEMBERSHIP on Linux.
+	// Not all platforms define this in the syscall package.
+	ipAddSourceMembershipLinux = 39
+)
+
+var (
+	// ErrInvalidGroup is thrown when a source filter is specified
+	// for an address that is not an IPv4 multicast group.
+	ErrInvalidGroup = errors.New("restreamer: source-specific multicast requires an IPv4 multicast group")
+	// ErrInvalidSource is thrown when the multicast source address can't be parsed.
+	ErrInvalidSource = errors.New("restreamer: invalid multicast source address")
+	// ErrSsmUnsupported is thrown when source-specific multicast
+	// is requested on a platform where it is not implemented.
+	ErrSsmUnsupported = errors.New("restreamer: source-specific multicast is not supported on this platform")
+)
+
+// ListenUdp opens a UDP socket for receiving datagrams, according to the
+// address specified in a udp:// or rtp:// URL.
+//
+// The URL format follows the conventions of other streaming software:
+//   udp://@239.1.1.1:1234 joins a multicast group
+//   udp://10.0.0.1@232.1.1.1:1234 joins a multicast group,
+//     but only accepts datagrams from the source 10.0.0.1 (SSM)
+//   udp://@:1234 or udp://:1234 receives unicast datagrams on all interfaces
+//   udp://192.168.0.1:1234 receives unicast datagrams on one local address
+//
+// The multicast interface can be selected with the iface query parameter,
+// for example: udp://@239.1.1.1:1234?iface=eth1
+// Otherwise, it is taken from binding, if set.
+// The source address may also be passed with the source query parameter.
+func ListenUdp(url *url.URL, binding Binding) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", url.Host)
+	if err != nil {
+		return nil, err
+	}
+	
+	var iface *net.Interface
+	if name := url.Query().Get("iface"); name != "" {
+		iface, err = net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	
+	source := url.Query().Get("source")
+	if url.User != nil && url.User.Username() != "" {
+		source = url.User.Username()
+	}
+	
+	var conn *net.UDPConn
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		if iface == nil {
+			iface, err = binding.MulticastInterface()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if source != "" {
+			conn, err = listenSourceMulticast(addr, iface, source)
+		} else {
+			conn, err = net.ListenMulticastUDP("udp", iface, addr)
+		}
+	} else {
+		if source != "" {
+			return nil, ErrInvalidGroup
+		}
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	
+	// this is only a hint, the OS may impose a lower limit
+	conn.SetReadBuffer(udpReceiveBuffer)
+	
+	return conn, nil
+}
+
+// listenSourceMulticast binds a socket to a multicast group and joins it
+// with a source filter, so only datagrams from a single sender are received.
+func listenSourceMulticast(group *net.UDPAddr, iface *net.Interface, source string) (*net.UDPConn, error) {
+	group4 := group.IP.To4()
+	if group4 == nil {
+		return nil, ErrInvalidGroup
+	}
+	source4 := net.ParseIP(source).To4()
+	if source4 == nil {
+		return nil, ErrInvalidSource
+	}
+	if runtime.GOOS != "linux" {
+		return nil, ErrSsmUnsupported
+	}
+	local4 := net.IPv4zero.To4()
+	if iface != nil {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				local4 = ipnet.IP.To4()
+				break
+			}
+		}
+	}
+	
+	// the socket must be bound to the group address, otherwise
+	// we would receive traffic from other groups on the same port
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{
+		IP: group4,
+		Port: group.Port,
+	})
+	if err != nil {
+		return nil, err
+	}
+	
+	// struct ip_mreq_source on Linux: multiaddr, interface, sourceaddr
+	var mreq [12]byte
+	copy(mreq[0:4], group4)
+	copy(mreq[4:8], local4)
+	copy(mreq[8:12], source4)
+	
+	raw, err := conn.SyscallConn()
+	if err == nil {
+		cerr := raw.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.IPPROTO_IP, ipAddSourceMembershipLinux, string(mreq[:]))
+		})
+		if cerr != nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	
+	return conn, nil
+}
+
+// DatagramReader turns a packet-oriented connection into a byte stream.
+//
+// Each datagram is received as a whole and then handed out in pieces of
+// arbitrary size. This is necessary because reading a datagram socket with
+// a short buffer discards the remainder of the datagram.
+type DatagramReader struct {
+	// conn is the datagram socket
+	conn net.Conn
+	// buffer holds the last received datagram
+	buffer []byte
+	// offset is the read position in the buffer
+	offset int
+	// length is the size of the last received datagram
+	length int
+}
+
+// NewDatagramReader creates a stream reader on top of a datagram socket.
+func NewDatagramReader(conn net.Conn) *DatagramReader {
+	return &DatagramReader{
+		conn: conn,
+		buffer: make([]byte, udpDatagramSize),
+	}
+}
+
+// Read copies data from the current datagram, receiving a new one
+// if all data has been consumed.
+func (reader *DatagramReader) Read(data []byte) (int, error) {
+	if reader.offset >= reader.length {
+		length, err := reader.conn.Read(reader.buffer)
+		if err != nil {
+			return 0, err
+		}
+		reader.offset = 0
+		reader.length = length
+	}
+	count := copy(data, reader.buffer[reader.offset:reader.length])
+	reader.offset += count
+	return count, nil
+}
+
+// Close closes the underlying socket.
+func (reader *DatagramReader) Close() error {
+	return reader.conn.Close()
+}
+
+// SetReadDeadline sets the read deadline of the underlying socket.
+func (reader *DatagramReader) SetReadDeadline(deadline time.Time) error {
+	return reader.conn.SetReadDeadline(deadline)
+}